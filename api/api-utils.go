@@ -1,8 +1,6 @@
 package api
 
 import (
-	"crypto/md5"
-	"encoding/hex"
 	"encoding/xml"
 	"fmt"
 	"net/http"
@@ -11,6 +9,8 @@ import (
 	"strings"
 	"time"
 
+	"github.com/Sirupsen/logrus"
+	"github.com/anduintransaction/fakes3/datastore"
 	"github.com/palantir/stacktrace"
 	uuid "github.com/satori/go.uuid"
 )
@@ -18,14 +18,42 @@ import (
 const (
 	defaultResponseNamespace = "http://s3.amazonaws.com/doc/2006-03-01/"
 	defaultXMLContentType    = "application/xml"
+	s3TimeFormat             = "2006-01-02T15:04:05.000Z"
 )
 
 type xmlErrorResponse struct {
-	XMLName   xml.Name `xml:"Error"`
-	Code      string   `xml:"Code"`
-	Message   string   `xml:"Message"`
-	RequestID string   `xml:"RequestId"`
-	HostID    string   `xml:"HostId"`
+	XMLName   xml.Name          `xml:"Error"`
+	Code      string            `xml:"Code"`
+	Message   string            `xml:"Message"`
+	Details   []*xmlErrorDetail `xml:",any"`
+	RequestID string            `xml:"RequestId"`
+	HostID    string            `xml:"HostId"`
+}
+
+// xmlErrorDetail is an element giving more context about an error, like the StringToSign of a signature mismatch
+type xmlErrorDetail struct {
+	XMLName xml.Name
+	Value   string `xml:",chardata"`
+}
+
+func newXMLErrorDetail(name, value string) *xmlErrorDetail {
+	return &xmlErrorDetail{
+		XMLName: xml.Name{Local: name},
+		Value:   value,
+	}
+}
+
+// xmlPrincipal is an Owner or Initiator element
+type xmlPrincipal struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+func newXMLPrincipal(principal *datastore.Principal) *xmlPrincipal {
+	return &xmlPrincipal{
+		ID:          principal.ID,
+		DisplayName: principal.DisplayName,
+	}
 }
 
 func queryKeyExists(params url.Values, key string) bool {
@@ -33,19 +61,31 @@ func queryKeyExists(params url.Values, key string) bool {
 	return ok
 }
 
+// presignedQueryParams lists the SigV2 parameters of presigned urls, SigV4 ones all start with X-Amz-
+var presignedQueryParams = map[string]bool{
+	"AWSAccessKeyId": true,
+	"Expires":        true,
+	"Signature":      true,
+}
+
+// hasSubresource tells if the query of a request selects a subresource, ignoring the signature of presigned urls
+func hasSubresource(params url.Values) bool {
+	for key := range params {
+		if !strings.HasPrefix(key, "X-Amz-") && !presignedQueryParams[key] {
+			return true
+		}
+	}
+	return false
+}
+
 func dumpRequest(r *http.Request) string {
 	dump, _ := httputil.DumpRequest(r, true)
 	return string(dump)
 }
 
-func generateETag(content []byte) string {
-	hasher := md5.New()
-	hasher.Write(content)
-	return hex.EncodeToString(hasher.Sum(nil))
-}
-
-func generateRandomETag() string {
-	return "\"" + generateETag(uuid.NewV4().Bytes()) + "\""
+// quoteETag returns an ETag in the quoted form used in s3 headers and responses
+func quoteETag(etag string) string {
+	return "\"" + etag + "\""
 }
 
 func notFoundResponse(w http.ResponseWriter, r *http.Request) {
@@ -54,10 +94,82 @@ func notFoundResponse(w http.ResponseWriter, r *http.Request) {
 }
 
 func errorResponse(w http.ResponseWriter) {
-	writeXMLErrorResponse(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.")
+	writeXMLErrorResponse(w, internalError.statusCode, internalError.code, internalError.message)
+}
+
+type s3Error struct {
+	statusCode int
+	code       string
+	message    string
+}
+
+var internalError = &s3Error{http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again."}
+
+// storageErrors maps codes of errors returned by the datastore package to s3 errors
+var storageErrors = map[stacktrace.ErrorCode]*s3Error{
+	datastore.ErrCodeNoSuchBucket:              {http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist"},
+	datastore.ErrCodeNoSuchKey:                 {http.StatusNotFound, "NoSuchKey", "The specified key does not exist."},
+	datastore.ErrCodeBucketAlreadyExists:       {http.StatusConflict, "BucketAlreadyOwnedByYou", "Your previous request to create the named bucket succeeded and you already own it."},
+	datastore.ErrCodeBucketNotEmpty:            {http.StatusConflict, "BucketNotEmpty", "The bucket you tried to delete is not empty"},
+	datastore.ErrCodeInvalidPart:               {http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found. The part may not have been uploaded, or the specified entity tag may not match the part's entity tag."},
+	datastore.ErrCodeInvalidPartOrder:          {http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order. Parts must be ordered by part number."},
+	datastore.ErrCodeEntityTooSmall:            {http.StatusBadRequest, "EntityTooSmall", "Your proposed upload is smaller than the minimum allowed object size."},
+	datastore.ErrCodeNoSuchUpload:              {http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist. The upload ID may be invalid, or the upload may have been aborted or completed."},
+	datastore.ErrCodeInvalidBucketName:         {http.StatusBadRequest, "InvalidBucketName", "The specified bucket is not valid."},
+	datastore.ErrCodeKeyTooLong:                {http.StatusBadRequest, "KeyTooLongError", "Your key is too long"},
+	datastore.ErrCodeIncompleteBody:            {http.StatusBadRequest, "IncompleteBody", "You did not provide the number of bytes specified by the Content-Length HTTP header"},
+	datastore.ErrCodeBadDigest:                 {http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what we received."},
+	datastore.ErrCodeSHA256Mismatch:            {http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed."},
+	datastore.ErrCodeInvalidObjectKey:          {http.StatusBadRequest, "InvalidArgument", "The specified key is not valid."},
+	datastore.ErrCodeChecksumMismatch:          {http.StatusBadRequest, "BadDigest", "The checksum you specified did not match the calculated checksum."},
+	datastore.ErrCodeMalformedPayload:          {http.StatusBadRequest, "IncompleteBody", "The request body is not a valid aws-chunked encoded payload."},
+	datastore.ErrCodePayloadSignatureMismatch:  {http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided. Check your key and signing method."},
+	datastore.ErrCodeEntityTooLarge:            {http.StatusBadRequest, "EntityTooLarge", "Your proposed upload exceeds the maximum allowed size"},
+	datastore.ErrCodeChecksumAlgorithmMismatch: {http.StatusBadRequest, "InvalidRequest", "The checksum algorithm of the part does not match the checksum algorithm of the multipart upload."},
+}
+
+// storageError returns the s3 error matching the code of an error returned by the datastore package, and logs it
+func storageError(err error) *s3Error {
+	s3Err, ok := storageErrors[stacktrace.GetCode(err)]
+	if !ok {
+		logrus.Error(err)
+		return internalError
+	}
+	logrus.Warn(err)
+	return s3Err
+}
+
+// storageErrorResponse writes the s3 error matching the code of an error returned by the datastore package
+func storageErrorResponse(w http.ResponseWriter, err error) {
+	s3Err := storageError(err)
+	writeXMLErrorResponse(w, s3Err.statusCode, s3Err.code, s3Err.message)
+}
+
+// storageHeadErrorResponse is storageErrorResponse for HEAD requests, which only get the status code
+func storageHeadErrorResponse(w http.ResponseWriter, err error) {
+	s3Err := storageError(err)
+	writeCommonHeaders(w.Header())
+	w.WriteHeader(s3Err.statusCode)
+}
+
+func preconditionFailedResponse(w http.ResponseWriter) {
+	writeXMLErrorResponse(w, http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+}
+
+func badDigestResponse(w http.ResponseWriter) {
+	s3Err := storageErrors[datastore.ErrCodeBadDigest]
+	writeXMLErrorResponse(w, s3Err.statusCode, s3Err.code, s3Err.message)
+}
+
+func malformedXMLResponse(w http.ResponseWriter) {
+	writeXMLErrorResponse(w, http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema")
 }
 
 func writeXMLErrorResponse(w http.ResponseWriter, statusCode int, code, message string) error {
+	return writeXMLErrorResponseWithDetails(w, statusCode, code, message, nil)
+}
+
+func writeXMLErrorResponseWithDetails(w http.ResponseWriter, statusCode int, code, message string, details []*xmlErrorDetail) error {
 	requestID := uuid.NewV4().String()
 	responseHeader := w.Header()
 	responseHeader.Add("Server", "AmazonS3")
@@ -68,6 +180,7 @@ func writeXMLErrorResponse(w http.ResponseWriter, statusCode int, code, message
 	errXML := &xmlErrorResponse{
 		Code:      code,
 		Message:   message,
+		Details:   details,
 		RequestID: requestID,
 		HostID:    "fakes3",
 	}
@@ -75,6 +188,7 @@ func writeXMLErrorResponse(w http.ResponseWriter, statusCode int, code, message
 	if err != nil {
 		return stacktrace.Propagate(err, "Cannot marshal xml")
 	}
+	responseHeader.Set("Content-Type", defaultXMLContentType)
 	w.WriteHeader(statusCode)
 	_, err = w.Write(content)
 	return stacktrace.Propagate(err, "Cannot write response")
@@ -94,12 +208,17 @@ func writeEmptySuccessResponse(w http.ResponseWriter) error {
 }
 
 func writeXMLResponse(w http.ResponseWriter, response interface{}) error {
+	return writeXMLResponseWithStatus(w, http.StatusOK, response)
+}
+
+func writeXMLResponseWithStatus(w http.ResponseWriter, statusCode int, response interface{}) error {
 	writeCommonHeaders(w.Header())
 	content, err := xml.Marshal(response)
 	if err != nil {
 		return stacktrace.Propagate(err, "Cannot marshal response to xml")
 	}
 	w.Header().Add("Content-Type", defaultXMLContentType)
+	w.WriteHeader(statusCode)
 	_, err = w.Write(content)
 	return stacktrace.Propagate(err, "Cannot write response")
 }
@@ -116,6 +235,27 @@ func extractObjectKeyFromPath(path string) string {
 	return strings.TrimPrefix(unescapedPath, "/")
 }
 
+// requestAccessKeyID returns the access key id the request claims to be signed with, or an empty string for anonymous requests
+func requestAccessKeyID(r *http.Request) string {
+	authorization := r.Header.Get("Authorization")
+	switch {
+	case strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 "):
+		for _, field := range strings.Split(strings.TrimPrefix(authorization, "AWS4-HMAC-SHA256 "), ",") {
+			field = strings.TrimSpace(field)
+			if strings.HasPrefix(field, "Credential=") {
+				return strings.SplitN(strings.TrimPrefix(field, "Credential="), "/", 2)[0]
+			}
+		}
+	case strings.HasPrefix(authorization, "AWS "):
+		return strings.SplitN(strings.TrimPrefix(authorization, "AWS "), ":", 2)[0]
+	}
+	queryParams := r.URL.Query()
+	if credential := queryParams.Get("X-Amz-Credential"); credential != "" {
+		return strings.SplitN(credential, "/", 2)[0]
+	}
+	return queryParams.Get("AWSAccessKeyId")
+}
+
 func calculateAdvertiseAddress(advertisedAddress string, r *http.Request) string {
 	if advertisedAddress != "" {
 		return advertisedAddress
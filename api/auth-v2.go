@@ -0,0 +1,118 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// signedSubresourcesV2 lists the query parameters that are part of a SigV2 string to sign
+var signedSubresourcesV2 = map[string]bool{
+	"acl":                          true,
+	"cors":                         true,
+	"delete":                       true,
+	"lifecycle":                    true,
+	"location":                     true,
+	"logging":                      true,
+	"notification":                 true,
+	"partNumber":                   true,
+	"policy":                       true,
+	"requestPayment":               true,
+	"response-cache-control":       true,
+	"response-content-disposition": true,
+	"response-content-encoding":    true,
+	"response-content-language":    true,
+	"response-content-type":        true,
+	"response-expires":             true,
+	"restore":                      true,
+	"tagging":                      true,
+	"torrent":                      true,
+	"uploadId":                     true,
+	"uploads":                      true,
+	"versionId":                    true,
+	"versioning":                   true,
+	"versions":                     true,
+	"website":                      true,
+}
+
+// verifyPresignedV2 checks a legacy SigV2 presigned url, signed with the AWSAccessKeyId, Expires and Signature query parameters
+func (s *Server) verifyPresignedV2(r *http.Request, now time.Time) (*requestAuth, *authError) {
+	queryParams := r.URL.Query()
+	accessKeyID := queryParams.Get("AWSAccessKeyId")
+	signature := queryParams.Get("Signature")
+	expires, err := strconv.ParseInt(queryParams.Get("Expires"), 10, 64)
+	if accessKeyID == "" || err != nil {
+		return nil, newAuthError(http.StatusForbidden, "AccessDenied", "Query-string authentication requires the Signature, Expires and AWSAccessKeyId parameters")
+	}
+	identity, secretAccessKey, ok := s.lookupAccessKey(accessKeyID)
+	if !ok {
+		return nil, newAuthError(http.StatusForbidden, "InvalidAccessKeyId", "The AWS Access Key Id you provided does not exist in our records.",
+			newXMLErrorDetail("AWSAccessKeyId", accessKeyID))
+	}
+	if now.Unix() > expires {
+		return nil, newAuthError(http.StatusForbidden, "AccessDenied", "Request has expired",
+			newXMLErrorDetail("Expires", time.Unix(expires, 0).UTC().Format(time.RFC3339)),
+			newXMLErrorDetail("ServerTime", now.Format(time.RFC3339)))
+	}
+	stringToSign := stringToSignV2(r, queryParams.Get("Expires"))
+	if !hmac.Equal([]byte(signV2(secretAccessKey, stringToSign)), []byte(signature)) {
+		return nil, newAuthError(http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided. Check your key and signing method.",
+			newXMLErrorDetail("AWSAccessKeyId", accessKeyID),
+			newXMLErrorDetail("StringToSign", stringToSign),
+			newXMLErrorDetail("SignatureProvided", signature),
+			newXMLErrorDetail("StringToSignBytes", hexBytes(stringToSign)))
+	}
+	return &requestAuth{accessKeyID: accessKeyID, identity: identity}, nil
+}
+
+// stringToSignV2 returns the SigV2 string to sign of a request, expires replacing the Date header of presigned urls
+func stringToSignV2(r *http.Request, expires string) string {
+	amzHeaders := []string{}
+	for name, values := range r.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") {
+			amzHeaders = append(amzHeaders, name+":"+strings.TrimSpace(strings.Join(values, ","))+"\n")
+		}
+	}
+	sort.Strings(amzHeaders)
+	return strings.Join([]string{
+		r.Method,
+		r.Header.Get("Content-MD5"),
+		r.Header.Get("Content-Type"),
+		expires,
+		strings.Join(amzHeaders, "") + canonicalResourceV2(r.URL),
+	}, "\n")
+}
+
+// canonicalResourceV2 returns the path of a request as sent, followed by its sorted signed subresources
+func canonicalResourceV2(u *url.URL) string {
+	subresources := []string{}
+	for name, values := range u.Query() {
+		if !signedSubresourcesV2[name] {
+			continue
+		}
+		if values[0] == "" {
+			subresources = append(subresources, name)
+			continue
+		}
+		subresources = append(subresources, name+"="+values[0])
+	}
+	sort.Strings(subresources)
+	if len(subresources) == 0 {
+		return u.EscapedPath()
+	}
+	return u.EscapedPath() + "?" + strings.Join(subresources, "&")
+}
+
+// signV2 returns the base64 SigV2 signature of a string to sign
+func signV2(secretAccessKey, stringToSign string) string {
+	mac := hmac.New(sha1.New, []byte(secretAccessKey))
+	mac.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,494 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/anduintransaction/fakes3/config"
+	"github.com/anduintransaction/fakes3/datastore"
+)
+
+const (
+	signV4Algorithm = "AWS4-HMAC-SHA256"
+	amzDateFormat   = "20060102T150405Z"
+	// maxClockSkew is how far the time of a signed request can be from the server time
+	maxClockSkew = 15 * time.Minute
+	// emptySHA256 is the hex sha256 of an empty content
+	emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	// maxPresignedExpiry is the longest validity of a SigV4 presigned url
+	maxPresignedExpiry = 7 * 24 * time.Hour
+	// maxSignedBodySize bounds the bodies of signed requests other than uploads, which are buffered to be verified before being handled
+	maxSignedBodySize = 16 * 1024 * 1024
+)
+
+type authContextKey struct{}
+
+// requestAuth holds the signature a request was authenticated with, to verify the signatures of its payload chunks
+type requestAuth struct {
+	accessKeyID string
+	identity    *datastore.Identity
+	payloadHash string // signed x-amz-content-sha256, empty for SigV2
+	signature   string // hex signature of the request
+	amzDate     string // time of the request, in amzDateFormat
+	scope       string // <date>/<region>/s3/aws4_request
+	signingKey  []byte
+}
+
+// sign returns the hex signature of a string to sign
+func (a *requestAuth) sign(stringToSign string) string {
+	return hex.EncodeToString(hmacSHA256(a.signingKey, stringToSign))
+}
+
+// signatureV4 holds the fields of a SigV4 signature, sent in the Authorization header or in the query string
+type signatureV4 struct {
+	accessKeyID   string
+	date          string // date of the credential scope, in yyyymmdd format
+	region        string
+	service       string
+	terminator    string
+	signedHeaders []string
+	signature     string
+	amzDate       string
+	payloadHash   string
+	presigned     bool
+	expires       time.Duration // validity of a presigned request from amzDate
+}
+
+func (sig *signatureV4) scope() string {
+	return strings.Join([]string{sig.date, sig.region, sig.service, sig.terminator}, "/")
+}
+
+// authError is an authentication failure, returned as an s3 error
+type authError struct {
+	statusCode int
+	code       string
+	message    string
+	details    []*xmlErrorDetail
+}
+
+func newAuthError(statusCode int, code, message string, details ...*xmlErrorDetail) *authError {
+	return &authError{
+		statusCode: statusCode,
+		code:       code,
+		message:    message,
+		details:    details,
+	}
+}
+
+func malformedAuthError(sig *signatureV4, message string) *authError {
+	if sig != nil && sig.presigned {
+		return newAuthError(http.StatusBadRequest, "AuthorizationQueryParametersError", message)
+	}
+	return newAuthError(http.StatusBadRequest, "AuthorizationHeaderMalformed", message)
+}
+
+// authenticate is a middleware verifying the signature of requests when authentication is enabled
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// CORS preflight requests are never signed, browser based uploads are authenticated by their policy
+		if !s.config.S3ApiServer.Auth.Enabled || r.Method == http.MethodOptions || isPostPolicyRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		auth, authErr := s.verifySignature(r, time.Now().UTC())
+		if authErr == nil {
+			authErr = verifyPayloadHash(r, auth.payloadHash)
+		}
+		if authErr != nil {
+			logrus.Warnf("Rejecting %s %s: %s", r.Method, r.URL.Path, authErr.message)
+			writeAuthErrorResponse(w, r, authErr)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authContextKey{}, auth)))
+	})
+}
+
+// requestAuthentication returns how a request was authenticated, nil for anonymous requests
+func requestAuthentication(r *http.Request) *requestAuth {
+	auth, _ := r.Context().Value(authContextKey{}).(*requestAuth)
+	return auth
+}
+
+func writeAuthErrorResponse(w http.ResponseWriter, r *http.Request, authErr *authError) {
+	if r.Method == http.MethodHead {
+		writeCommonHeaders(w.Header())
+		w.WriteHeader(authErr.statusCode)
+		return
+	}
+	err := writeXMLErrorResponseWithDetails(w, authErr.statusCode, authErr.code, authErr.message, authErr.details)
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+// verifySignature checks the signature of a request against the configured access keys.
+// Requests are signed with SigV4, presigned urls may also use the legacy SigV2
+func (s *Server) verifySignature(r *http.Request, now time.Time) (*requestAuth, *authError) {
+	if r.Header.Get("Authorization") == "" && r.URL.Query().Get("Signature") != "" {
+		return s.verifyPresignedV2(r, now)
+	}
+	authConfig := s.config.S3ApiServer.Auth
+	sig, authErr := parseSignatureV4(r)
+	if authErr != nil {
+		return nil, authErr
+	}
+	identity, secretAccessKey, ok := s.lookupAccessKey(sig.accessKeyID)
+	if !ok {
+		return nil, newAuthError(http.StatusForbidden, "InvalidAccessKeyId", "The AWS Access Key Id you provided does not exist in our records.",
+			newXMLErrorDetail("AWSAccessKeyId", sig.accessKeyID))
+	}
+	if sig.region != authConfig.Region {
+		return nil, malformedAuthError(sig, fmt.Sprintf("The authorization header is malformed; the region '%s' is wrong; expecting '%s'", sig.region, authConfig.Region))
+	}
+	if sig.service != "s3" || sig.terminator != "aws4_request" {
+		return nil, malformedAuthError(sig, fmt.Sprintf("The authorization header is malformed; incorrect service '%s' or terminal '%s'", sig.service, sig.terminator))
+	}
+	requestTime, err := time.Parse(amzDateFormat, sig.amzDate)
+	if err != nil {
+		return nil, newAuthError(http.StatusForbidden, "AccessDenied", "AWS authentication requires a valid Date or x-amz-date header")
+	}
+	if sig.date != requestTime.Format("20060102") {
+		return nil, malformedAuthError(sig, fmt.Sprintf("The authorization header is malformed; Invalid credential date. Date is not the same as X-Amz-Date: \"%s\".", sig.date))
+	}
+	// Presigned requests are checked against their expiry instead, they only can't be signed in the future
+	skew := now.Sub(requestTime)
+	if (skew > maxClockSkew && !sig.presigned) || skew < -maxClockSkew {
+		return nil, newAuthError(http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the current time is too large.",
+			newXMLErrorDetail("RequestTime", sig.amzDate),
+			newXMLErrorDetail("ServerTime", now.Format(time.RFC3339)),
+			newXMLErrorDetail("MaxAllowedSkewMilliseconds", strconv.FormatInt(int64(maxClockSkew/time.Millisecond), 10)))
+	}
+	if sig.presigned && now.After(requestTime.Add(sig.expires)) {
+		return nil, newAuthError(http.StatusForbidden, "AccessDenied", "Request has expired",
+			newXMLErrorDetail("X-Amz-Expires", strconv.FormatInt(int64(sig.expires/time.Second), 10)),
+			newXMLErrorDetail("Expires", requestTime.Add(sig.expires).Format(time.RFC3339)),
+			newXMLErrorDetail("ServerTime", now.Format(time.RFC3339)))
+	}
+	if unsigned := unsignedAmzHeaders(r.Header, sig.signedHeaders); len(unsigned) > 0 {
+		return nil, newAuthError(http.StatusForbidden, "AccessDenied", "There were headers present in the request which were not signed",
+			newXMLErrorDetail("HeadersNotSigned", strings.Join(unsigned, ", ")))
+	}
+	auth := &requestAuth{
+		accessKeyID: sig.accessKeyID,
+		identity:    identity,
+		payloadHash: sig.payloadHash,
+		signature:   sig.signature,
+		amzDate:     sig.amzDate,
+		scope:       sig.scope(),
+		signingKey:  signingKey(secretAccessKey, sig.date, sig.region, sig.service),
+	}
+	canonicalRequest := canonicalRequestV4(r, sig)
+	stringToSign := strings.Join([]string{signV4Algorithm, sig.amzDate, auth.scope, sha256Hex(canonicalRequest)}, "\n")
+	if !hmac.Equal([]byte(auth.sign(stringToSign)), []byte(sig.signature)) {
+		return nil, newAuthError(http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided. Check your key and signing method.",
+			newXMLErrorDetail("AWSAccessKeyId", sig.accessKeyID),
+			newXMLErrorDetail("StringToSign", stringToSign),
+			newXMLErrorDetail("SignatureProvided", sig.signature),
+			newXMLErrorDetail("StringToSignBytes", hexBytes(stringToSign)),
+			newXMLErrorDetail("CanonicalRequest", canonicalRequest),
+			newXMLErrorDetail("CanonicalRequestBytes", hexBytes(canonicalRequest)))
+	}
+	return auth, nil
+}
+
+// isObjectUpload tells if a request uploads an object or a part, whose payload is verified while it is stored
+func isObjectUpload(r *http.Request) bool {
+	return r.Method == http.MethodPut && strings.Contains(strings.Trim(r.URL.Path, "/"), "/") && r.Header.Get("x-amz-copy-source") == ""
+}
+
+// verifyPayloadHash checks the body of a signed request other than an upload against its signed x-amz-content-sha256,
+// so it cannot be changed without breaking the signature. The body is buffered and replaced by the verified content
+func verifyPayloadHash(r *http.Request, payloadHash string) *authError {
+	if payloadHash == "" || payloadHash == unsignedPayload || strings.HasPrefix(payloadHash, "STREAMING-") || isObjectUpload(r) {
+		return nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSignedBodySize+1))
+	if err != nil {
+		s3Err := storageErrors[datastore.ErrCodeIncompleteBody]
+		return newAuthError(s3Err.statusCode, s3Err.code, s3Err.message)
+	}
+	if len(body) > maxSignedBodySize {
+		return newAuthError(http.StatusBadRequest, "MaxMessageLengthExceeded", "Your request was too big.")
+	}
+	if computed := sha256Hex(string(body)); computed != payloadHash {
+		s3Err := storageErrors[datastore.ErrCodeSHA256Mismatch]
+		return newAuthError(s3Err.statusCode, s3Err.code, s3Err.message,
+			newXMLErrorDetail("ClientComputedContentSHA256", payloadHash),
+			newXMLErrorDetail("S3ComputedContentSHA256", computed))
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return nil
+}
+
+// lookupAccessKey returns the identity and the secret of an access key of the config file or of the credential storage,
+// or false if the access key does not exist. Access keys of the config file belong to the default account
+func lookupAccessKey(authConfig *config.AuthConfig, credentialStorage *datastore.CredentialStorage, accessKeyID string) (*datastore.Identity, string, bool) {
+	for _, accessKey := range authConfig.AccessKeys {
+		if accessKey.AccessKeyID == accessKeyID {
+			return datastore.DefaultIdentity(), accessKey.SecretAccessKey, true
+		}
+	}
+	identity, secretAccessKey, err := credentialStorage.LookupAccessKey(accessKeyID)
+	if err != nil {
+		logrus.Error(err)
+		return nil, "", false
+	}
+	return identity, secretAccessKey, identity != nil
+}
+
+func (s *Server) lookupAccessKey(accessKeyID string) (*datastore.Identity, string, bool) {
+	return lookupAccessKey(s.config.S3ApiServer.Auth, s.credentialStorage, accessKeyID)
+}
+
+// callerIdentity returns the identity of the caller of a request. When authentication is disabled, callers are
+// identified by the access key they claim to sign with, anonymous ones are the root of the default account
+func (s *Server) callerIdentity(r *http.Request) *datastore.Identity {
+	if auth := requestAuthentication(r); auth != nil && auth.identity != nil {
+		return auth.identity
+	}
+	if identity, _, ok := s.lookupAccessKey(requestAccessKeyID(r)); ok {
+		return identity
+	}
+	return datastore.DefaultIdentity()
+}
+
+// parseSignatureV4 extracts the SigV4 signature of a request from its Authorization header or its query string
+func parseSignatureV4(r *http.Request) (*signatureV4, *authError) {
+	authorization := r.Header.Get("Authorization")
+	queryParams := r.URL.Query()
+	switch {
+	case strings.HasPrefix(authorization, signV4Algorithm+" "):
+		return parseAuthorizationHeader(r.Header, strings.TrimPrefix(authorization, signV4Algorithm+" "))
+	case authorization != "":
+		return nil, newAuthError(http.StatusBadRequest, "InvalidRequest", "The authorization mechanism you have provided is not supported. Please use AWS4-HMAC-SHA256.")
+	case queryParams.Get("X-Amz-Algorithm") != "":
+		return parsePresignedQuery(queryParams)
+	default:
+		return nil, newAuthError(http.StatusForbidden, "AccessDenied", "Access Denied")
+	}
+}
+
+func parseAuthorizationHeader(requestHeader http.Header, authorization string) (*signatureV4, *authError) {
+	fields := map[string]string{}
+	for _, field := range strings.Split(authorization, ",") {
+		parts := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(parts) != 2 {
+			return nil, malformedAuthError(nil, fmt.Sprintf("The authorization header is malformed; the authorization component \"%s\" is malformed.", strings.TrimSpace(field)))
+		}
+		fields[parts[0]] = parts[1]
+	}
+	sig := &signatureV4{
+		signature:   fields["Signature"],
+		amzDate:     requestHeader.Get("x-amz-date"),
+		payloadHash: requestHeader.Get("x-amz-content-sha256"),
+	}
+	if fields["Credential"] == "" || fields["SignedHeaders"] == "" || sig.signature == "" {
+		return nil, malformedAuthError(nil, "The authorization header is malformed; the authorization header requires three components: Credential, SignedHeaders, and Signature.")
+	}
+	if !parseCredential(sig, fields["Credential"]) {
+		return nil, malformedAuthError(nil, "The authorization header is malformed; the Credential is mal-formed; expecting \"<YOUR-AKID>/YYYYMMDD/REGION/SERVICE/aws4_request\".")
+	}
+	sig.signedHeaders = strings.Split(fields["SignedHeaders"], ";")
+	if sig.amzDate == "" {
+		if date, err := http.ParseTime(requestHeader.Get("Date")); err == nil {
+			sig.amzDate = date.UTC().Format(amzDateFormat)
+		}
+	}
+	if sig.payloadHash == "" {
+		return nil, newAuthError(http.StatusBadRequest, "InvalidRequest", "Missing required header for this request: x-amz-content-sha256")
+	}
+	return sig, nil
+}
+
+func parsePresignedQuery(queryParams url.Values) (*signatureV4, *authError) {
+	sig := &signatureV4{
+		signature:   queryParams.Get("X-Amz-Signature"),
+		amzDate:     queryParams.Get("X-Amz-Date"),
+		payloadHash: queryParams.Get("X-Amz-Content-Sha256"),
+		presigned:   true,
+	}
+	if queryParams.Get("X-Amz-Algorithm") != signV4Algorithm {
+		return nil, malformedAuthError(sig, "X-Amz-Algorithm only supports \"AWS4-HMAC-SHA256\"")
+	}
+	if queryParams.Get("X-Amz-Credential") == "" || queryParams.Get("X-Amz-SignedHeaders") == "" || sig.signature == "" || sig.amzDate == "" || queryParams.Get("X-Amz-Expires") == "" {
+		return nil, malformedAuthError(sig, "Query-string authentication version 4 requires the X-Amz-Algorithm, X-Amz-Credential, X-Amz-Signature, X-Amz-Date, X-Amz-SignedHeaders, and X-Amz-Expires parameters.")
+	}
+	expires, err := strconv.ParseInt(queryParams.Get("X-Amz-Expires"), 10, 64)
+	if err != nil || expires < 0 {
+		return nil, malformedAuthError(sig, "X-Amz-Expires should be a number")
+	}
+	sig.expires = time.Duration(expires) * time.Second
+	if sig.expires > maxPresignedExpiry {
+		return nil, malformedAuthError(sig, "X-Amz-Expires must be less than a week (in seconds) that is 604800")
+	}
+	if !parseCredential(sig, queryParams.Get("X-Amz-Credential")) {
+		return nil, malformedAuthError(sig, "Error parsing the X-Amz-Credential parameter; the Credential is mal-formed; expecting \"<YOUR-AKID>/YYYYMMDD/REGION/SERVICE/aws4_request\".")
+	}
+	sig.signedHeaders = strings.Split(queryParams.Get("X-Amz-SignedHeaders"), ";")
+	if sig.payloadHash == "" {
+		sig.payloadHash = unsignedPayload
+	}
+	return sig, nil
+}
+
+// parseCredential parses a <access key id>/<date>/<region>/<service>/aws4_request credential into a signature
+func parseCredential(sig *signatureV4, credential string) bool {
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 {
+		return false
+	}
+	sig.accessKeyID, sig.date, sig.region, sig.service, sig.terminator = parts[0], parts[1], parts[2], parts[3], parts[4]
+	return true
+}
+
+// unsignedAmzHeaders returns the x-amz-* headers of a request that are not part of its signature
+func unsignedAmzHeaders(requestHeader http.Header, signedHeaders []string) []string {
+	signed := map[string]bool{}
+	for _, name := range signedHeaders {
+		signed[name] = true
+	}
+	unsigned := []string{}
+	for name := range requestHeader {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") && !signed[name] {
+			unsigned = append(unsigned, name)
+		}
+	}
+	sort.Strings(unsigned)
+	return unsigned
+}
+
+// canonicalRequestV4 returns the canonical form of a request that is hashed in its string to sign
+func canonicalRequestV4(r *http.Request, sig *signatureV4) string {
+	canonicalHeaders := make([]string, 0, len(sig.signedHeaders))
+	for _, name := range sig.signedHeaders {
+		canonicalHeaders = append(canonicalHeaders, name+":"+canonicalHeaderValue(r, name)+"\n")
+	}
+	return strings.Join([]string{
+		r.Method,
+		canonicalURI(r.URL),
+		canonicalQueryString(r.URL.RawQuery, sig.presigned),
+		strings.Join(canonicalHeaders, ""),
+		strings.Join(sig.signedHeaders, ";"),
+		sig.payloadHash,
+	}, "\n")
+}
+
+// canonicalHeaderValue returns the trimmed values of a request header, including the headers net/http moves out of the header map
+func canonicalHeaderValue(r *http.Request, name string) string {
+	values := r.Header[http.CanonicalHeaderKey(name)]
+	switch {
+	case name == "host":
+		values = []string{r.Host}
+	case name == "content-length" && len(values) == 0:
+		values = []string{strconv.FormatInt(r.ContentLength, 10)}
+	case name == "transfer-encoding" && len(values) == 0:
+		values = r.TransferEncoding
+	}
+	trimmed := make([]string, 0, len(values))
+	for _, value := range values {
+		trimmed = append(trimmed, strings.Join(strings.Fields(value), " "))
+	}
+	return strings.Join(trimmed, ",")
+}
+
+// canonicalURI returns the escaped path of a request, keeping escaped slashes of its segments
+func canonicalURI(u *url.URL) string {
+	segments := strings.Split(u.EscapedPath(), "/")
+	for i, segment := range segments {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			unescaped = segment
+		}
+		segments[i] = uriEncode(unescaped)
+	}
+	return strings.Join(segments, "/")
+}
+
+// canonicalQueryString returns the escaped query parameters sorted by name then value,
+// without the signature of presigned requests
+func canonicalQueryString(rawQuery string, presigned bool) string {
+	params := [][2]string{}
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param == "" {
+			continue
+		}
+		// The SDKs escape spaces as %20, a + is a literal plus sign
+		parts := strings.SplitN(param, "=", 2)
+		name, _ := url.PathUnescape(parts[0])
+		value := ""
+		if len(parts) == 2 {
+			value, _ = url.PathUnescape(parts[1])
+		}
+		if presigned && name == "X-Amz-Signature" {
+			continue
+		}
+		params = append(params, [2]string{uriEncode(name), uriEncode(value)})
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i][0] != params[j][0] {
+			return params[i][0] < params[j][0]
+		}
+		return params[i][1] < params[j][1]
+	})
+	encoded := make([]string, 0, len(params))
+	for _, param := range params {
+		encoded = append(encoded, param[0]+"="+param[1])
+	}
+	return strings.Join(encoded, "&")
+}
+
+// uriEncode escapes every byte but unreserved characters, like the AWS SDKs
+func uriEncode(value string) string {
+	encoded := make([]byte, 0, len(value))
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			encoded = append(encoded, c)
+			continue
+		}
+		encoded = append(encoded, fmt.Sprintf("%%%02X", c)...)
+	}
+	return string(encoded)
+}
+
+// signingKey derives the key signing the requests of a day, region and service from a secret access key
+func signingKey(secretAccessKey, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+func hmacSHA256(key []byte, content string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(content))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// hexBytes formats a string as space separated hex bytes, like the *Bytes elements of s3 signature errors
+func hexBytes(content string) string {
+	encoded := make([]string, 0, len(content))
+	for i := 0; i < len(content); i++ {
+		encoded = append(encoded, fmt.Sprintf("%02x", content[i]))
+	}
+	return strings.Join(encoded, " ")
+}
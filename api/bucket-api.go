@@ -0,0 +1,31 @@
+package api
+
+import (
+	"net/http"
+)
+
+func (s *Server) getBucketRoute(w http.ResponseWriter, r *http.Request) {
+	queryParams := r.URL.Query()
+	switch {
+	case queryKeyExists(queryParams, "location"):
+		s.getBucketLocation(w, r)
+	case queryKeyExists(queryParams, "uploads"):
+		s.listMultipartUploads(w, r)
+	case queryParams.Get("list-type") == "2":
+		s.listObjectsV2(w, r)
+	default:
+		s.listObjectsV1(w, r)
+	}
+}
+
+func (s *Server) postBucketRoute(w http.ResponseWriter, r *http.Request) {
+	queryParams := r.URL.Query()
+	switch {
+	case queryKeyExists(queryParams, "delete"):
+		s.deleteObjects(w, r)
+	case !hasSubresource(queryParams):
+		s.postPolicyUpload(w, r)
+	default:
+		notFoundResponse(w, r)
+	}
+}
@@ -0,0 +1,152 @@
+package api
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/anduintransaction/fakes3/datastore"
+	"github.com/palantir/stacktrace"
+	"goji.io/pat"
+)
+
+type createBucketConfiguration struct {
+	XMLName            xml.Name `xml:"CreateBucketConfiguration"`
+	LocationConstraint string   `xml:"LocationConstraint"`
+}
+
+type listAllMyBucketsResult struct {
+	XMLName xml.Name          `xml:"ListAllMyBucketsResult"`
+	Xmlns   string            `xml:"xmlns,attr"`
+	Owner   *xmlPrincipal     `xml:"Owner"`
+	Buckets []*listBucketItem `xml:"Buckets>Bucket"`
+}
+
+type listBucketItem struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type locationConstraintResult struct {
+	XMLName            xml.Name `xml:"LocationConstraint"`
+	Xmlns              string   `xml:"xmlns,attr"`
+	LocationConstraint string   `xml:",chardata"`
+}
+
+func (s *Server) createBucket(w http.ResponseWriter, r *http.Request) {
+	bucket := pat.Param(r, "bucket")
+	logrus.Debugf("Creating bucket %q", bucket)
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		logrus.Error(err)
+		errorResponse(w)
+		return
+	}
+	configuration := &createBucketConfiguration{}
+	if len(body) > 0 {
+		err = xml.Unmarshal(body, configuration)
+		if err != nil {
+			logrus.Warn(err)
+			malformedXMLResponse(w)
+			return
+		}
+	}
+	err = s.bucketStorage.CreateBucket(bucket, configuration.LocationConstraint)
+	if err != nil && stacktrace.GetCode(err) == datastore.ErrCodeBucketAlreadyExists && s.ownedInUsEast1(bucket) {
+		// Like s3, re-creating a bucket you already own in us-east-1 succeeds
+		err = nil
+	}
+	if err != nil {
+		storageErrorResponse(w, err)
+		return
+	}
+	w.Header().Set("Location", "/"+bucket)
+	writeEmptySuccessResponse(w)
+}
+
+func (s *Server) deleteBucket(w http.ResponseWriter, r *http.Request) {
+	bucket := pat.Param(r, "bucket")
+	logrus.Debugf("Deleting bucket %q", bucket)
+	err := s.bucketStorage.DeleteBucket(bucket)
+	if err != nil {
+		storageErrorResponse(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	writeEmptySuccessResponse(w)
+}
+
+func (s *Server) headBucket(w http.ResponseWriter, r *http.Request) {
+	bucket := pat.Param(r, "bucket")
+	logrus.Debugf("Checking bucket %q", bucket)
+	bucketInfo, err := s.bucketStorage.GetBucket(bucket)
+	if err != nil {
+		storageHeadErrorResponse(w, err)
+		return
+	}
+	w.Header().Set("x-amz-bucket-region", bucketRegion(bucketInfo.Location))
+	writeEmptySuccessResponse(w)
+}
+
+func (s *Server) listBuckets(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug("Listing buckets")
+	buckets, err := s.bucketStorage.ListBuckets()
+	if err != nil {
+		logrus.Error(err)
+		errorResponse(w)
+		return
+	}
+	result := &listAllMyBucketsResult{
+		Xmlns:   defaultResponseNamespace,
+		Owner:   newXMLPrincipal(s.callerIdentity(r).Owner()),
+		Buckets: []*listBucketItem{},
+	}
+	for _, bucket := range buckets {
+		result.Buckets = append(result.Buckets, &listBucketItem{
+			Name:         bucket.Name,
+			CreationDate: bucket.CreationDate.UTC().Format(s3TimeFormat),
+		})
+	}
+	err = writeXMLResponse(w, result)
+	if err != nil {
+		logrus.Error(err)
+		errorResponse(w)
+	}
+}
+
+func (s *Server) getBucketLocation(w http.ResponseWriter, r *http.Request) {
+	bucket := pat.Param(r, "bucket")
+	logrus.Debugf("Getting location of bucket %q", bucket)
+	bucketInfo, err := s.bucketStorage.GetBucket(bucket)
+	if err != nil {
+		storageErrorResponse(w, err)
+		return
+	}
+	err = writeXMLResponse(w, &locationConstraintResult{
+		Xmlns:              defaultResponseNamespace,
+		LocationConstraint: bucketInfo.Location,
+	})
+	if err != nil {
+		logrus.Error(err)
+		errorResponse(w)
+	}
+}
+
+// ownedInUsEast1 tells if an existing bucket is in us-east-1, where creating it again is not an error
+func (s *Server) ownedInUsEast1(bucket string) bool {
+	bucketInfo, err := s.bucketStorage.GetBucket(bucket)
+	if err != nil {
+		logrus.Warn(err)
+		return false
+	}
+	return bucketRegion(bucketInfo.Location) == "us-east-1"
+}
+
+// bucketRegion returns the region of a bucket, an empty location constraint means us-east-1
+func bucketRegion(location string) string {
+	if location == "" {
+		return "us-east-1"
+	}
+	return location
+}
@@ -0,0 +1,41 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCreateExistingBucket(t *testing.T) {
+	s, cleanup := newTestServer(t, false)
+	defer cleanup()
+	for _, location := range []string{"us-east-1", "eu-west-1"} {
+		err := s.bucketStorage.CreateBucket(location+"-bucket", location)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		bucket         string
+		expectedStatus int
+	}{
+		// Buckets without location constraint are in us-east-1
+		{testBucket, http.StatusOK},
+		{"us-east-1-bucket", http.StatusOK},
+		{"eu-west-1-bucket", http.StatusConflict},
+	}
+	for _, test := range tests {
+		w := serveTestRequest(s, httptest.NewRequest(http.MethodPut, "/"+test.bucket, nil))
+		if w.Code != test.expectedStatus {
+			t.Errorf("Creating existing bucket %q returned %d, expecting %d: %s", test.bucket, w.Code, test.expectedStatus, w.Body.String())
+		}
+		if test.expectedStatus == http.StatusConflict && !strings.Contains(w.Body.String(), "<Code>BucketAlreadyOwnedByYou</Code>") {
+			t.Errorf("Creating existing bucket %q returned %s", test.bucket, w.Body.String())
+		}
+	}
+	bucketInfo, err := s.bucketStorage.GetBucket("eu-west-1-bucket")
+	if err != nil || bucketInfo.Location != "eu-west-1" {
+		t.Errorf("Existing bucket has info %+v after being created again, error %v", bucketInfo, err)
+	}
+}
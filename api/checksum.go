@@ -0,0 +1,159 @@
+package api
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/anduintransaction/fakes3/datastore"
+)
+
+const checksumModeEnabled = "ENABLED"
+
+// xmlChecksum holds the checksum elements of s3 responses, only the one of the object algorithm is set
+type xmlChecksum struct {
+	ChecksumCRC32     string `xml:"ChecksumCRC32,omitempty"`
+	ChecksumCRC32C    string `xml:"ChecksumCRC32C,omitempty"`
+	ChecksumCRC64NVME string `xml:"ChecksumCRC64NVME,omitempty"`
+	ChecksumSHA1      string `xml:"ChecksumSHA1,omitempty"`
+	ChecksumSHA256    string `xml:"ChecksumSHA256,omitempty"`
+	ChecksumType      string `xml:"ChecksumType,omitempty"`
+}
+
+func newXMLChecksum(algorithm, checksum, checksumType string) xmlChecksum {
+	result := xmlChecksum{ChecksumType: checksumType}
+	switch algorithm {
+	case datastore.ChecksumCRC32:
+		result.ChecksumCRC32 = checksum
+	case datastore.ChecksumCRC32C:
+		result.ChecksumCRC32C = checksum
+	case datastore.ChecksumCRC64NVME:
+		result.ChecksumCRC64NVME = checksum
+	case datastore.ChecksumSHA1:
+		result.ChecksumSHA1 = checksum
+	case datastore.ChecksumSHA256:
+		result.ChecksumSHA256 = checksum
+	}
+	return result
+}
+
+// value returns the checksum set by the client, whatever its algorithm
+func (c xmlChecksum) value() string {
+	for _, checksum := range []string{c.ChecksumCRC32, c.ChecksumCRC32C, c.ChecksumCRC64NVME, c.ChecksumSHA1, c.ChecksumSHA256} {
+		if checksum != "" {
+			return checksum
+		}
+	}
+	return ""
+}
+
+// checksumHeader returns the x-amz-checksum-* header holding the checksums of an algorithm
+func checksumHeader(algorithm string) string {
+	return "x-amz-checksum-" + strings.ToLower(algorithm)
+}
+
+// checksumHeaderAlgorithm returns the algorithm of a x-amz-checksum-* header name, or false if it is not one
+func checksumHeaderAlgorithm(name string) (string, bool) {
+	for _, algorithm := range datastore.ChecksumAlgorithms {
+		if strings.EqualFold(name, checksumHeader(algorithm)) {
+			return algorithm, true
+		}
+	}
+	return "", false
+}
+
+// writeChecksumHeaders writes the checksum of an object or part, if it has one
+func writeChecksumHeaders(responseHeader http.Header, algorithm, checksum, checksumType string) {
+	if algorithm == "" || checksum == "" {
+		return
+	}
+	responseHeader.Set(checksumHeader(algorithm), checksum)
+	if checksumType != "" {
+		responseHeader.Set("x-amz-checksum-type", checksumType)
+	}
+}
+
+// parseChecksumAlgorithm parses a header naming a checksum algorithm, returns an empty algorithm if the header is missing.
+// Returns false if the algorithm is not supported, in which case an error has been written to the response
+func parseChecksumAlgorithm(w http.ResponseWriter, requestHeader http.Header, name string) (string, bool) {
+	algorithm := strings.ToUpper(requestHeader.Get(name))
+	if algorithm == "" {
+		return "", true
+	}
+	if _, ok := datastore.NewChecksumHash(algorithm); !ok {
+		writeXMLErrorResponse(w, http.StatusBadRequest, "InvalidRequest", fmt.Sprintf("Checksum algorithm provided is unsupported. Please try again with any of the valid types: [%s]", strings.Join(datastore.ChecksumAlgorithms, ", ")))
+		return "", false
+	}
+	return algorithm, true
+}
+
+// parseChecksumHeaders returns the checksum algorithm and the expected checksum announced in the headers of an upload request.
+// The checksum is empty if only the algorithm is announced.
+// Returns false if the headers are invalid, in which case an error has been written to the response
+func parseChecksumHeaders(w http.ResponseWriter, requestHeader http.Header) (string, string, bool) {
+	algorithm, checksum := "", ""
+	for _, candidate := range datastore.ChecksumAlgorithms {
+		value := requestHeader.Get(checksumHeader(candidate))
+		if value == "" {
+			continue
+		}
+		if checksum != "" {
+			writeXMLErrorResponse(w, http.StatusBadRequest, "InvalidRequest", "Expecting a single x-amz-checksum- header. Multiple checksum Types are not allowed.")
+			return "", "", false
+		}
+		hasher, _ := datastore.NewChecksumHash(candidate)
+		sum, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(sum) != hasher.Size() {
+			writeXMLErrorResponse(w, http.StatusBadRequest, "InvalidRequest", fmt.Sprintf("Value for %s header is invalid.", checksumHeader(candidate)))
+			return "", "", false
+		}
+		algorithm, checksum = candidate, value
+	}
+	sdkAlgorithm, ok := parseChecksumAlgorithm(w, requestHeader, "x-amz-sdk-checksum-algorithm")
+	if !ok {
+		return "", "", false
+	}
+	if sdkAlgorithm != "" && algorithm != "" && sdkAlgorithm != algorithm {
+		writeXMLErrorResponse(w, http.StatusBadRequest, "InvalidRequest", "Value for x-amz-sdk-checksum-algorithm header is invalid.")
+		return "", "", false
+	}
+	if algorithm == "" {
+		algorithm = sdkAlgorithm
+	}
+	return algorithm, checksum, true
+}
+
+// parseMultipartChecksum parses the checksum algorithm and type requested when initiating a multipart upload.
+// Returns false if they are invalid, in which case an error has been written to the response
+func parseMultipartChecksum(w http.ResponseWriter, requestHeader http.Header) (string, string, bool) {
+	algorithm, ok := parseChecksumAlgorithm(w, requestHeader, "x-amz-checksum-algorithm")
+	if !ok {
+		return "", "", false
+	}
+	checksumType := strings.ToUpper(requestHeader.Get("x-amz-checksum-type"))
+	if algorithm == "" {
+		if checksumType != "" {
+			writeXMLErrorResponse(w, http.StatusBadRequest, "InvalidRequest", "The x-amz-checksum-type header can only be used with the x-amz-checksum-algorithm header.")
+			return "", "", false
+		}
+		return "", "", true
+	}
+	switch checksumType {
+	case "":
+		checksumType = datastore.ChecksumTypeComposite
+		if !datastore.SupportsCompositeChecksum(algorithm) {
+			checksumType = datastore.ChecksumTypeFullObject
+		}
+	case datastore.ChecksumTypeComposite, datastore.ChecksumTypeFullObject:
+	default:
+		writeXMLErrorResponse(w, http.StatusBadRequest, "InvalidRequest", "Value for x-amz-checksum-type header is invalid.")
+		return "", "", false
+	}
+	if (checksumType == datastore.ChecksumTypeComposite && !datastore.SupportsCompositeChecksum(algorithm)) ||
+		(checksumType == datastore.ChecksumTypeFullObject && !datastore.SupportsFullObjectChecksum(algorithm)) {
+		writeXMLErrorResponse(w, http.StatusBadRequest, "InvalidRequest", fmt.Sprintf("The %s checksum type cannot be used with the %s checksum algorithm.", checksumType, strings.ToLower(algorithm)))
+		return "", "", false
+	}
+	return algorithm, checksumType, true
+}
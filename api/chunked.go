@@ -0,0 +1,243 @@
+package api
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/anduintransaction/fakes3/datastore"
+	"github.com/palantir/stacktrace"
+)
+
+const (
+	awsChunkedEncoding = "aws-chunked"
+	// maxChunkLineSize bounds chunk headers and trailer lines, which only hold a size, a signature or a checksum
+	maxChunkLineSize = 4096
+)
+
+// isChunkedPayload tells if the body of a request is aws-chunked encoded
+func isChunkedPayload(requestHeader http.Header) bool {
+	return strings.HasPrefix(requestHeader.Get("x-amz-content-sha256"), "STREAMING-") ||
+		stripChunkedEncoding(requestHeader.Get("Content-Encoding")) != requestHeader.Get("Content-Encoding")
+}
+
+// stripChunkedEncoding removes aws-chunked from a Content-Encoding header, it describes the request body and not the object
+func stripChunkedEncoding(contentEncoding string) string {
+	if contentEncoding == "" {
+		return ""
+	}
+	encodings := []string{}
+	for _, encoding := range strings.Split(contentEncoding, ",") {
+		encoding = strings.TrimSpace(encoding)
+		if encoding != "" && !strings.EqualFold(encoding, awsChunkedEncoding) {
+			encodings = append(encodings, encoding)
+		}
+	}
+	return strings.Join(encodings, ",")
+}
+
+// chunkedReader decodes an aws-chunked body: chunks framed as "<hex size>[;chunk-signature=<signature>]\r\n<data>\r\n",
+// ended by a zero sized chunk optionally followed by trailing headers and an empty line
+type chunkedReader struct {
+	reader    *bufio.Reader
+	trailer   string // lower cased name of the announced trailing header, empty if none
+	remaining int64  // bytes left to read in the current chunk
+	trailers  map[string]string
+	err       error
+	// signer verifies chunk signatures, each one chained to the previous one starting from the request signature. nil for unsigned chunks
+	signer            *requestAuth
+	previousSignature string
+	chunkSignature    string
+	chunkHasher       hash.Hash
+}
+
+// newChunkedReader returns a reader decoding an aws-chunked body. signer is nil if chunk signatures are not verified
+func newChunkedReader(body io.Reader, trailer string, signer *requestAuth) *chunkedReader {
+	c := &chunkedReader{
+		reader:   bufio.NewReaderSize(body, maxChunkLineSize),
+		trailer:  strings.ToLower(trailer),
+		trailers: map[string]string{},
+		signer:   signer,
+	}
+	if signer != nil {
+		c.previousSignature = signer.signature
+	}
+	return c
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	for c.err == nil && c.remaining == 0 {
+		c.err = c.nextChunk()
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.reader.Read(p)
+	c.remaining -= int64(n)
+	if c.chunkHasher != nil {
+		c.chunkHasher.Write(p[:n])
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil && c.remaining == 0 {
+		err = c.readChunkEnd()
+	}
+	if err == nil && c.remaining == 0 {
+		err = c.verifyChunk()
+	}
+	c.err = err
+	return n, err
+}
+
+// trailingValue returns the value of the announced trailing header, empty until the body has been read
+func (c *chunkedReader) trailingValue() string {
+	return c.trailers[c.trailer]
+}
+
+// nextChunk reads the header of the next chunk, or the trailer after the last one in which case io.EOF is returned
+func (c *chunkedReader) nextChunk() error {
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	sizeField, extension := line, ""
+	if idx := strings.IndexByte(line, ';'); idx >= 0 {
+		sizeField, extension = line[:idx], line[idx+1:]
+	}
+	size, err := strconv.ParseInt(sizeField, 16, 64)
+	if err != nil || size < 0 {
+		return stacktrace.NewErrorWithCode(datastore.ErrCodeMalformedPayload, "Invalid chunk header %q", line)
+	}
+	if c.signer != nil {
+		if !strings.HasPrefix(extension, "chunk-signature=") {
+			return stacktrace.NewErrorWithCode(datastore.ErrCodeMalformedPayload, "Chunk header %q has no signature", line)
+		}
+		c.chunkSignature = strings.TrimPrefix(extension, "chunk-signature=")
+		c.chunkHasher = sha256.New()
+	}
+	if size > 0 {
+		c.remaining = size
+		return nil
+	}
+	err = c.verifyChunk()
+	if err != nil {
+		return err
+	}
+	return c.readTrailer()
+}
+
+// verifyChunk checks the signature of the chunk that has just been read, when chunks are signed
+func (c *chunkedReader) verifyChunk() error {
+	if c.signer == nil {
+		return nil
+	}
+	stringToSign := strings.Join([]string{
+		signV4Algorithm + "-PAYLOAD",
+		c.signer.amzDate,
+		c.signer.scope,
+		c.previousSignature,
+		emptySHA256,
+		hex.EncodeToString(c.chunkHasher.Sum(nil)),
+	}, "\n")
+	if !hmac.Equal([]byte(c.signer.sign(stringToSign)), []byte(c.chunkSignature)) {
+		return stacktrace.NewErrorWithCode(datastore.ErrCodePayloadSignatureMismatch, "Chunk signature %q does not match", c.chunkSignature)
+	}
+	c.previousSignature = c.chunkSignature
+	return nil
+}
+
+// verifyTrailer checks the signature of the trailing headers, when chunks are signed
+func (c *chunkedReader) verifyTrailer(canonicalTrailer string) error {
+	if c.signer == nil {
+		return nil
+	}
+	trailerSignature := c.trailers["x-amz-trailer-signature"]
+	stringToSign := strings.Join([]string{
+		signV4Algorithm + "-TRAILER",
+		c.signer.amzDate,
+		c.signer.scope,
+		c.previousSignature,
+		sha256Hex(canonicalTrailer),
+	}, "\n")
+	if !hmac.Equal([]byte(c.signer.sign(stringToSign)), []byte(trailerSignature)) {
+		return stacktrace.NewErrorWithCode(datastore.ErrCodePayloadSignatureMismatch, "Trailer signature %q does not match", trailerSignature)
+	}
+	return nil
+}
+
+// readTrailer reads the trailing headers following the last chunk, up to the empty line ending the body
+func (c *chunkedReader) readTrailer() error {
+	canonicalTrailer := ""
+	for {
+		line, err := c.readLine()
+		// Bodies without trailer may omit the final empty line
+		if err == io.ErrUnexpectedEOF && c.trailer == "" && len(c.trailers) == 0 {
+			return io.EOF
+		}
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			break
+		}
+		idx := strings.IndexByte(line, ':')
+		if idx < 0 {
+			return stacktrace.NewErrorWithCode(datastore.ErrCodeMalformedPayload, "Invalid trailing header %q", line)
+		}
+		name, value := strings.ToLower(strings.TrimSpace(line[:idx])), strings.TrimSpace(line[idx+1:])
+		c.trailers[name] = value
+		if name != "x-amz-trailer-signature" {
+			canonicalTrailer += name + ":" + value + "\n"
+		}
+	}
+	if c.trailer != "" && c.trailingValue() == "" {
+		return stacktrace.NewErrorWithCode(datastore.ErrCodeMalformedPayload, "Missing trailing header %q", c.trailer)
+	}
+	if c.trailer != "" {
+		err := c.verifyTrailer(canonicalTrailer)
+		if err != nil {
+			return err
+		}
+	}
+	return io.EOF
+}
+
+// readLine reads a line ended by CRLF and returns it without its line ending
+func (c *chunkedReader) readLine() (string, error) {
+	line, err := c.reader.ReadSlice('\n')
+	if err == io.EOF {
+		return "", io.ErrUnexpectedEOF
+	}
+	if err == bufio.ErrBufferFull {
+		return "", stacktrace.NewErrorWithCode(datastore.ErrCodeMalformedPayload, "Chunk line longer than %d bytes", maxChunkLineSize)
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", stacktrace.NewErrorWithCode(datastore.ErrCodeMalformedPayload, "Chunk line %q does not end with CRLF", line)
+	}
+	return string(line[:len(line)-2]), nil
+}
+
+// readChunkEnd reads the CRLF following the data of a chunk
+func (c *chunkedReader) readChunkEnd() error {
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	if line != "" {
+		return stacktrace.NewErrorWithCode(datastore.ErrCodeMalformedPayload, "Chunk data followed by %q", line)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/anduintransaction/fakes3/datastore"
+	"github.com/palantir/stacktrace"
+)
+
+func TestChunkedReader(t *testing.T) {
+	const checksumTrailer = "x-amz-checksum-crc32"
+	tests := []struct {
+		name            string
+		body            string
+		trailer         string
+		expectedContent string
+		expectedTrailer string
+		expectedError   stacktrace.ErrorCode
+		truncated       bool // io.ErrUnexpectedEOF is expected
+	}{
+		{"SingleChunk", "5\r\nhello\r\n0\r\n\r\n", "", "hello", "", stacktrace.NoCode, false},
+		{"SeveralChunks", "5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n", "", "hello world", "", stacktrace.NoCode, false},
+		{"HexSize", "b\r\nhello world\r\n0\r\n\r\n", "", "hello world", "", stacktrace.NoCode, false},
+		{"EmptyBody", "0\r\n\r\n", "", "", "", stacktrace.NoCode, false},
+		{"UnverifiedSignatures", "5;chunk-signature=abc\r\nhello\r\n0;chunk-signature=def\r\n\r\n", "", "hello", "", stacktrace.NoCode, false},
+		{"NoFinalEmptyLine", "5\r\nhello\r\n0\r\n", "", "hello", "", stacktrace.NoCode, false},
+		{"Trailer", "5\r\nhello\r\n0\r\nx-amz-checksum-crc32:NhCmhg==\r\n\r\n", checksumTrailer, "hello", "NhCmhg==", stacktrace.NoCode, false},
+		{"TrailerCaseAndSpaces", "5\r\nhello\r\n0\r\nX-Amz-Checksum-Crc32: NhCmhg== \r\n\r\n", "X-Amz-Checksum-Crc32", "hello", "NhCmhg==", stacktrace.NoCode, false},
+		{"SeveralTrailers", "5\r\nhello\r\n0\r\nx-other:value\r\nx-amz-checksum-crc32:NhCmhg==\r\n\r\n", checksumTrailer, "hello", "NhCmhg==", stacktrace.NoCode, false},
+		{"MissingTrailer", "5\r\nhello\r\n0\r\n\r\n", checksumTrailer, "", "", datastore.ErrCodeMalformedPayload, false},
+		{"OtherTrailer", "5\r\nhello\r\n0\r\nx-other:value\r\n\r\n", checksumTrailer, "", "", datastore.ErrCodeMalformedPayload, false},
+		{"InvalidTrailer", "5\r\nhello\r\n0\r\nno colon\r\n\r\n", "", "", "", datastore.ErrCodeMalformedPayload, false},
+		{"InvalidSize", "zz\r\nhello\r\n0\r\n\r\n", "", "", "", datastore.ErrCodeMalformedPayload, false},
+		{"NegativeSize", "-5\r\nhello\r\n0\r\n\r\n", "", "", "", datastore.ErrCodeMalformedPayload, false},
+		{"HeaderWithoutCR", "5\nhello\r\n0\r\n\r\n", "", "", "", datastore.ErrCodeMalformedPayload, false},
+		{"DataWithoutCRLF", "5\r\nhello0\r\n\r\n", "", "", "", datastore.ErrCodeMalformedPayload, false},
+		{"DataWithoutCR", "5\r\nhello\n0\r\n\r\n", "", "", "", datastore.ErrCodeMalformedPayload, false},
+		{"DataLongerThanSize", "4\r\nhello\r\n0\r\n\r\n", "", "", "", datastore.ErrCodeMalformedPayload, false},
+		{"TrailerWithoutCR", "5\r\nhello\r\n0\r\nx-amz-checksum-crc32:NhCmhg==\n\r\n", checksumTrailer, "", "", datastore.ErrCodeMalformedPayload, false},
+		{"LineTooLong", strings.Repeat("0", maxChunkLineSize+1) + "5\r\nhello\r\n0\r\n\r\n", "", "", "", datastore.ErrCodeMalformedPayload, false},
+		{"Empty", "", "", "", "", stacktrace.NoCode, true},
+		{"TruncatedHeader", "5", "", "", "", stacktrace.NoCode, true},
+		{"TruncatedData", "5\r\nhel", "", "", "", stacktrace.NoCode, true},
+		{"TruncatedChunkEnd", "5\r\nhello\r", "", "", "", stacktrace.NoCode, true},
+		{"NoLastChunk", "5\r\nhello\r\n", "", "", "", stacktrace.NoCode, true},
+		{"TruncatedTrailer", "5\r\nhello\r\n0\r\nx-amz-checksum-crc32:NhCmhg==\r\n", checksumTrailer, "", "", stacktrace.NoCode, true},
+	}
+	for _, test := range tests {
+		reader := newChunkedReader(strings.NewReader(test.body), test.trailer, nil)
+		content, err := ioutil.ReadAll(reader)
+		switch {
+		case test.truncated:
+			if err != io.ErrUnexpectedEOF {
+				t.Errorf("%s: returned %v, expecting %v", test.name, err, io.ErrUnexpectedEOF)
+			}
+		case test.expectedError != stacktrace.NoCode:
+			if err == nil || stacktrace.GetCode(err) != test.expectedError {
+				t.Errorf("%s: returned %v, expecting error code %d", test.name, err, test.expectedError)
+			}
+		case err != nil:
+			t.Errorf("%s: %s", test.name, err)
+		case string(content) != test.expectedContent || reader.trailingValue() != test.expectedTrailer:
+			t.Errorf("%s: decoded %q with trailer %q, expecting %q with trailer %q", test.name, content, reader.trailingValue(), test.expectedContent, test.expectedTrailer)
+		}
+	}
+}
+
+func TestIsChunkedPayload(t *testing.T) {
+	tests := []struct {
+		contentSHA256    string
+		contentEncoding  string
+		expected         bool
+		strippedEncoding string
+	}{
+		{"STREAMING-AWS4-HMAC-SHA256-PAYLOAD", "", true, ""},
+		{"STREAMING-UNSIGNED-PAYLOAD-TRAILER", "aws-chunked", true, ""},
+		{"UNSIGNED-PAYLOAD", "aws-chunked", true, ""},
+		{"UNSIGNED-PAYLOAD", "gzip, AWS-Chunked", true, "gzip"},
+		{"UNSIGNED-PAYLOAD", "aws-chunked,gzip,br", true, "gzip,br"},
+		{"UNSIGNED-PAYLOAD", "gzip", false, "gzip"},
+		{emptySHA256, "", false, ""},
+	}
+	for _, test := range tests {
+		header := http.Header{}
+		header.Set("x-amz-content-sha256", test.contentSHA256)
+		header.Set("Content-Encoding", test.contentEncoding)
+		if isChunkedPayload(header) != test.expected {
+			t.Errorf("isChunkedPayload(%q, %q) is %v", test.contentSHA256, test.contentEncoding, !test.expected)
+		}
+		if stripped := stripChunkedEncoding(test.contentEncoding); stripped != test.strippedEncoding {
+			t.Errorf("stripChunkedEncoding(%q) is %q, expecting %q", test.contentEncoding, stripped, test.strippedEncoding)
+		}
+	}
+}
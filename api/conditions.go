@@ -0,0 +1,67 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/anduintransaction/fakes3/datastore"
+)
+
+type conditionResult int
+
+const (
+	conditionsMet conditionResult = iota
+	conditionNotModified
+	conditionPreconditionFailed
+)
+
+// evaluateConditions evaluates the if-match, if-none-match, if-modified-since and if-unmodified-since headers,
+// optionally prefixed as for x-amz-copy-source-*, against an object
+func evaluateConditions(requestHeader http.Header, headerPrefix string, objectInfo *datastore.ObjectInfo) conditionResult {
+	etag := objectInfo.Metadata.ETag
+	lastModified := objectInfo.LastModified.Truncate(time.Second)
+	ifMatch := requestHeader.Get(headerPrefix + "if-match")
+	ifNoneMatch := requestHeader.Get(headerPrefix + "if-none-match")
+	ifModifiedSince, hasIfModifiedSince := parseHTTPDateHeader(requestHeader, headerPrefix+"if-modified-since")
+	ifUnmodifiedSince, hasIfUnmodifiedSince := parseHTTPDateHeader(requestHeader, headerPrefix+"if-unmodified-since")
+	// A matching if-match wins over a failing if-unmodified-since, a failing if-none-match wins over a matching if-modified-since
+	if ifMatch != "" {
+		if !etagMatches(ifMatch, etag) {
+			return conditionPreconditionFailed
+		}
+	} else if hasIfUnmodifiedSince && lastModified.After(ifUnmodifiedSince) {
+		return conditionPreconditionFailed
+	}
+	if ifNoneMatch != "" {
+		if etagMatches(ifNoneMatch, etag) {
+			return conditionNotModified
+		}
+	} else if hasIfModifiedSince && !lastModified.After(ifModifiedSince) {
+		return conditionNotModified
+	}
+	return conditionsMet
+}
+
+// etagMatches checks an If-Match/If-None-Match style header value (a list of quoted ETags or *) against an unquoted ETag
+func etagMatches(headerValue, etag string) bool {
+	for _, candidate := range strings.Split(headerValue, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.Trim(candidate, "\"") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func parseHTTPDateHeader(requestHeader http.Header, name string) (time.Time, bool) {
+	value := requestHeader.Get(name)
+	if value == "" {
+		return time.Time{}, false
+	}
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/anduintransaction/fakes3/datastore"
+)
+
+func TestEvaluateConditions(t *testing.T) {
+	lastModified := time.Date(2020, 6, 15, 12, 0, 0, 500, time.UTC)
+	objectInfo := &datastore.ObjectInfo{LastModified: lastModified, Metadata: &datastore.ObjectMetadata{ETag: "etag"}}
+	before := lastModified.Add(-time.Hour).Format(http.TimeFormat)
+	at := lastModified.Format(http.TimeFormat)
+	after := lastModified.Add(time.Hour).Format(http.TimeFormat)
+	tests := []struct {
+		name              string
+		ifMatch           string
+		ifNoneMatch       string
+		ifModifiedSince   string
+		ifUnmodifiedSince string
+		expected          conditionResult
+	}{
+		{"NoConditions", "", "", "", "", conditionsMet},
+		{"IfMatch", `"etag"`, "", "", "", conditionsMet},
+		{"IfMatchUnquoted", "etag", "", "", "", conditionsMet},
+		{"IfMatchList", `"other", "etag"`, "", "", "", conditionsMet},
+		{"IfMatchAny", "*", "", "", "", conditionsMet},
+		{"IfMatchFailed", `"other"`, "", "", "", conditionPreconditionFailed},
+		{"IfNoneMatch", "", `"other"`, "", "", conditionsMet},
+		{"IfNoneMatchFailed", "", `"etag"`, "", "", conditionNotModified},
+		{"IfNoneMatchAny", "", "*", "", "", conditionNotModified},
+		{"IfModifiedSince", "", "", before, "", conditionsMet},
+		{"IfModifiedSinceLastModified", "", "", at, "", conditionNotModified},
+		{"IfModifiedSinceFailed", "", "", after, "", conditionNotModified},
+		{"IfModifiedSinceInvalid", "", "", "yesterday", "", conditionsMet},
+		{"IfUnmodifiedSince", "", "", "", after, conditionsMet},
+		{"IfUnmodifiedSinceLastModified", "", "", "", at, conditionsMet},
+		{"IfUnmodifiedSinceFailed", "", "", "", before, conditionPreconditionFailed},
+		// A matching if-match wins over a failing if-unmodified-since
+		{"IfMatchAndIfUnmodifiedSinceFailed", `"etag"`, "", "", before, conditionsMet},
+		{"IfMatchFailedAndIfUnmodifiedSince", `"other"`, "", "", after, conditionPreconditionFailed},
+		// A failing if-none-match wins over a matching if-modified-since
+		{"IfNoneMatchFailedAndIfModifiedSince", "", `"etag"`, before, "", conditionNotModified},
+		{"IfNoneMatchAndIfModifiedSinceFailed", "", `"other"`, after, "", conditionsMet},
+		// Failed preconditions win over not modified
+		{"IfMatchFailedAndIfNoneMatchFailed", `"other"`, `"etag"`, "", "", conditionPreconditionFailed},
+		{"IfUnmodifiedSinceFailedAndIfModifiedSinceFailed", "", "", after, before, conditionPreconditionFailed},
+		{"IfMatchAndIfNoneMatchFailed", `"etag"`, `"etag"`, "", "", conditionNotModified},
+	}
+	for _, test := range tests {
+		for _, headerPrefix := range []string{"", "x-amz-copy-source-"} {
+			requestHeader := http.Header{}
+			for name, value := range map[string]string{
+				"if-match":            test.ifMatch,
+				"if-none-match":       test.ifNoneMatch,
+				"if-modified-since":   test.ifModifiedSince,
+				"if-unmodified-since": test.ifUnmodifiedSince,
+			} {
+				if value != "" {
+					requestHeader.Set(headerPrefix+name, value)
+				}
+			}
+			// Conditions with another prefix are ignored
+			requestHeader.Set("x-other-if-match", `"other"`)
+			if actual := evaluateConditions(requestHeader, headerPrefix, objectInfo); actual != test.expected {
+				t.Errorf("%s with prefix %q is %d, expecting %d", test.name, headerPrefix, actual, test.expected)
+			}
+		}
+	}
+}
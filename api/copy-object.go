@@ -0,0 +1,123 @@
+package api
+
+import (
+	"encoding/xml"
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/anduintransaction/fakes3/datastore"
+	"goji.io/pat"
+	"goji.io/pattern"
+)
+
+const (
+	copyDirective    = "COPY"
+	replaceDirective = "REPLACE"
+)
+
+type copyObjectResult struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	Xmlns        string   `xml:"xmlns,attr"`
+	LastModified string   `xml:"LastModified"`
+	ETag         string   `xml:"ETag"`
+	xmlChecksum
+}
+
+func (s *Server) copyObject(w http.ResponseWriter, r *http.Request) {
+	bucket := pat.Param(r, "bucket")
+	objectKey := extractObjectKeyFromPath(pattern.Path(r.Context()))
+	sourceBucket, sourceKey, ok := parseCopySource(r.Header.Get("x-amz-copy-source"))
+	if !ok {
+		writeXMLErrorResponse(w, http.StatusBadRequest, "InvalidArgument", "Copy Source must mention the source bucket and key: sourcebucket/sourcekey")
+		return
+	}
+	logrus.Debugf("Copying object %q from bucket %q to object %q in bucket %q", sourceKey, sourceBucket, objectKey, bucket)
+	metadataDirective, ok := parseDirective(w, r.Header, "x-amz-metadata-directive", "Unknown metadata directive.")
+	if !ok {
+		return
+	}
+	taggingDirective, ok := parseDirective(w, r.Header, "x-amz-tagging-directive", "Unknown tagging directive.")
+	if !ok {
+		return
+	}
+	requestMetadata, ok := parseObjectMetadata(w, r.Header)
+	if !ok {
+		return
+	}
+	checksumAlgorithm, ok := parseChecksumAlgorithm(w, r.Header, "x-amz-checksum-algorithm")
+	if !ok {
+		return
+	}
+	isSelfCopy := sourceBucket == bucket && sourceKey == objectKey
+	if isSelfCopy && metadataDirective != replaceDirective {
+		writeXMLErrorResponse(w, http.StatusBadRequest, "InvalidRequest", "This copy request is illegal because it is trying to copy an object to itself without changing the object's metadata, storage class, website redirect location or encryption attributes.")
+		return
+	}
+	f, sourceInfo, err := s.objectStorage.OpenObject(sourceBucket, sourceKey)
+	if err != nil {
+		storageErrorResponse(w, err)
+		return
+	}
+	defer f.Close()
+	if !copySourceConditionsMet(r.Header, sourceInfo) {
+		preconditionFailedResponse(w)
+		return
+	}
+	metadata := requestMetadata
+	if metadataDirective == copyDirective {
+		metadata = copyObjectMetadata(sourceInfo.Metadata)
+	}
+	metadata.Tags = requestMetadata.Tags
+	if taggingDirective == copyDirective {
+		metadata.Tags = sourceInfo.Metadata.Tags
+	}
+	var objectInfo *datastore.ObjectInfo
+	if isSelfCopy {
+		objectInfo, err = s.objectStorage.UpdateMetadata(bucket, objectKey, metadata)
+	} else {
+		// Copies keep the checksum algorithm of their source unless another one is requested
+		payload := datastore.NewPayload(f, sourceInfo.Size)
+		payload.ChecksumAlgorithm = sourceInfo.Metadata.ChecksumAlgorithm
+		if checksumAlgorithm != "" {
+			payload.ChecksumAlgorithm = checksumAlgorithm
+		}
+		objectInfo, err = s.objectStorage.PutObject(bucket, objectKey, payload, metadata)
+	}
+	if err != nil {
+		storageErrorResponse(w, err)
+		return
+	}
+	err = writeXMLResponse(w, &copyObjectResult{
+		Xmlns:        defaultResponseNamespace,
+		LastModified: objectInfo.LastModified.UTC().Format(s3TimeFormat),
+		ETag:         quoteETag(objectInfo.Metadata.ETag),
+		xmlChecksum:  newXMLChecksum(objectInfo.Metadata.ChecksumAlgorithm, objectInfo.Metadata.Checksum, objectInfo.Metadata.ChecksumType),
+	})
+	if err != nil {
+		logrus.Error(err)
+		errorResponse(w)
+	}
+}
+
+// parseDirective parses a COPY/REPLACE directive header, COPY being the default.
+// Returns false if the value is invalid, in which case an error has been written to the response
+func parseDirective(w http.ResponseWriter, requestHeader http.Header, name, invalidMessage string) (string, bool) {
+	directive := requestHeader.Get(name)
+	switch directive {
+	case "":
+		return copyDirective, true
+	case copyDirective, replaceDirective:
+		return directive, true
+	default:
+		writeXMLErrorResponse(w, http.StatusBadRequest, "InvalidArgument", invalidMessage)
+		return "", false
+	}
+}
+
+// copyObjectMetadata returns the metadata of a source object to store with its copy
+func copyObjectMetadata(source *datastore.ObjectMetadata) *datastore.ObjectMetadata {
+	metadata := *source
+	metadata.ETag = ""
+	metadata.PartSizes = nil
+	return &metadata
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/anduintransaction/fakes3/datastore"
+)
+
+// parseCopySource extracts the source bucket and key from the x-amz-copy-source header
+func parseCopySource(copySource string) (string, string, bool) {
+	if idx := strings.Index(copySource, "?"); idx >= 0 {
+		copySource = copySource[:idx]
+	}
+	unescapedSource, err := url.PathUnescape(copySource)
+	if err != nil {
+		return "", "", false
+	}
+	segments := strings.SplitN(strings.TrimPrefix(unescapedSource, "/"), "/", 2)
+	if len(segments) != 2 || segments[0] == "" || segments[1] == "" {
+		return "", "", false
+	}
+	return segments[0], segments[1], true
+}
+
+// copySourceConditionsMet evaluates the x-amz-copy-source-if-* headers against the source object
+func copySourceConditionsMet(requestHeader http.Header, objectInfo *datastore.ObjectInfo) bool {
+	return evaluateConditions(requestHeader, "x-amz-copy-source-", objectInfo) == conditionsMet
+}
+
+// parseCopySourceRange parses the x-amz-copy-source-range header (bytes=first-last) against the source object size
+func parseCopySourceRange(copySourceRange string, size int64) (int64, int64, bool) {
+	if !strings.HasPrefix(copySourceRange, "bytes=") {
+		return 0, 0, false
+	}
+	bounds := strings.SplitN(strings.TrimPrefix(copySourceRange, "bytes="), "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, false
+	}
+	first, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	last, err := strconv.ParseInt(bounds[1], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	if first < 0 || last < first || last >= size {
+		return 0, 0, false
+	}
+	return first, last, true
+}
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+	"goji.io/pat"
+)
+
+const maxDeleteObjects = 1000
+
+type deleteObjectsRequest struct {
+	XMLName xml.Name                  `xml:"Delete"`
+	Quiet   bool                      `xml:"Quiet"`
+	Objects []*deleteObjectIdentifier `xml:"Object"`
+}
+
+type deleteObjectIdentifier struct {
+	Key       string `xml:"Key"`
+	VersionID string `xml:"VersionId"`
+}
+
+type deleteResult struct {
+	XMLName xml.Name              `xml:"DeleteResult"`
+	Xmlns   string                `xml:"xmlns,attr"`
+	Deleted []*deletedObject      `xml:"Deleted"`
+	Errors  []*deleteObjectsError `xml:"Error"`
+}
+
+type deletedObject struct {
+	Key string `xml:"Key"`
+}
+
+type deleteObjectsError struct {
+	Key     string `xml:"Key"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (s *Server) deleteObjects(w http.ResponseWriter, r *http.Request) {
+	bucket := pat.Param(r, "bucket")
+	logrus.Debugf("Deleting objects from bucket %q", bucket)
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		logrus.Error(err)
+		errorResponse(w)
+		return
+	}
+	if !verifyBodyMD5(w, r.Header, body) {
+		return
+	}
+	request := &deleteObjectsRequest{}
+	err = xml.Unmarshal(body, request)
+	if err != nil || len(request.Objects) == 0 || len(request.Objects) > maxDeleteObjects {
+		logrus.Warnf("Invalid delete objects request: %q", body)
+		malformedXMLResponse(w)
+		return
+	}
+	_, err = s.bucketStorage.GetBucket(bucket)
+	if err != nil {
+		storageErrorResponse(w, err)
+		return
+	}
+	result := &deleteResult{
+		Xmlns: defaultResponseNamespace,
+	}
+	for _, object := range request.Objects {
+		err := s.objectStorage.DeleteObject(bucket, object.Key)
+		if err != nil {
+			s3Err := storageError(err)
+			result.Errors = append(result.Errors, &deleteObjectsError{
+				Key:     object.Key,
+				Code:    s3Err.code,
+				Message: s3Err.message,
+			})
+			continue
+		}
+		if !request.Quiet {
+			result.Deleted = append(result.Deleted, &deletedObject{
+				Key: object.Key,
+			})
+		}
+	}
+	err = writeXMLResponse(w, result)
+	if err != nil {
+		logrus.Error(err)
+		errorResponse(w)
+	}
+}
+
+// verifyBodyMD5 checks the mandatory Content-MD5 header against a request body already read.
+// Returns false if it is missing or does not match, in which case an error has been written to the response
+func verifyBodyMD5(w http.ResponseWriter, requestHeader http.Header, body []byte) bool {
+	expectedMD5, ok := parseContentMD5(w, requestHeader)
+	if !ok {
+		return false
+	}
+	actualMD5 := md5.Sum(body)
+	if !bytes.Equal(expectedMD5, actualMD5[:]) {
+		badDigestResponse(w)
+		return false
+	}
+	return true
+}
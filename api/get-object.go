@@ -0,0 +1,239 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/anduintransaction/fakes3/datastore"
+	"goji.io/pat"
+	"goji.io/pattern"
+)
+
+// responseOverrides maps the query parameters of a GET request to the response headers they override
+var responseOverrides = map[string]string{
+	"response-content-type":        "Content-Type",
+	"response-content-language":    "Content-Language",
+	"response-expires":             "Expires",
+	"response-cache-control":       "Cache-Control",
+	"response-content-disposition": "Content-Disposition",
+	"response-content-encoding":    "Content-Encoding",
+}
+
+type rangeResult int
+
+const (
+	rangeIgnored rangeResult = iota
+	rangeSatisfiable
+	rangeNotSatisfiable
+)
+
+func (s *Server) getObject(w http.ResponseWriter, r *http.Request) {
+	bucket := pat.Param(r, "bucket")
+	objectKey := extractObjectKeyFromPath(pattern.Path(r.Context()))
+	logrus.Debugf("Getting object %q from bucket %q", objectKey, bucket)
+	f, objectInfo, err := s.objectStorage.OpenObject(bucket, objectKey)
+	if err != nil {
+		storageErrorResponse(w, err)
+		return
+	}
+	defer f.Close()
+	serveObject(w, r, objectInfo, f)
+}
+
+func (s *Server) headObject(w http.ResponseWriter, r *http.Request) {
+	bucket := pat.Param(r, "bucket")
+	objectKey := extractObjectKeyFromPath(pattern.Path(r.Context()))
+	logrus.Debugf("Getting object info %q from bucket %q", objectKey, bucket)
+	objectInfo, err := s.objectStorage.GetObjectInfo(bucket, objectKey)
+	if err != nil {
+		storageHeadErrorResponse(w, err)
+		return
+	}
+	serveObject(w, r, objectInfo, nil)
+}
+
+// serveObject answers a GET or HEAD object request: it evaluates the conditional headers,
+// selects the requested range or part and writes it. content is nil for HEAD requests
+func serveObject(w http.ResponseWriter, r *http.Request, objectInfo *datastore.ObjectInfo, content io.ReaderAt) {
+	responseHeader := w.Header()
+	addCORSHeaders(w)
+	switch evaluateConditions(r.Header, "", objectInfo) {
+	case conditionPreconditionFailed:
+		objectErrorResponse(w, r, http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+		return
+	case conditionNotModified:
+		responseHeader.Set("Last-Modified", objectInfo.LastModified.UTC().Format(http.TimeFormat))
+		responseHeader.Set("ETag", quoteETag(objectInfo.Metadata.ETag))
+		writeCommonHeaders(responseHeader)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	size := objectInfo.Size
+	start, length := int64(0), size
+	partial := false
+	partNumber := 0
+	queryParams := r.URL.Query()
+	rangeHeader := r.Header.Get("Range")
+	if queryKeyExists(queryParams, "partNumber") {
+		if rangeHeader != "" {
+			objectErrorResponse(w, r, http.StatusBadRequest, "InvalidRequest", "Cannot specify both Range header and partNumber query parameter")
+			return
+		}
+		var err error
+		partNumber, err = strconv.Atoi(queryParams.Get("partNumber"))
+		if err != nil || partNumber < 1 || partNumber > maxPartNumber {
+			objectErrorResponse(w, r, http.StatusBadRequest, "InvalidArgument", "Part number must be an integer between 1 and 10000, inclusive")
+			return
+		}
+		var ok bool
+		start, length, ok = partRange(objectInfo, partNumber)
+		if !ok {
+			objectErrorResponse(w, r, http.StatusRequestedRangeNotSatisfiable, "InvalidPartNumber", "The requested partnumber is not satisfiable")
+			return
+		}
+		if partsCount := len(objectInfo.Metadata.PartSizes); partsCount > 0 {
+			responseHeader.Set("x-amz-mp-parts-count", strconv.Itoa(partsCount))
+		}
+		partial = length > 0
+	} else if rangeHeader != "" {
+		var result rangeResult
+		start, length, result = parseRange(rangeHeader, size)
+		switch result {
+		case rangeNotSatisfiable:
+			responseHeader.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			objectErrorResponse(w, r, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable")
+			return
+		case rangeSatisfiable:
+			partial = true
+		}
+	}
+	writeObjectHeaders(w, objectInfo)
+	// Checksums are only returned for whole objects or parts, not for arbitrary ranges
+	if r.Header.Get("x-amz-checksum-mode") == checksumModeEnabled && (partNumber > 0 || !partial) {
+		checksum, checksumType := objectChecksum(objectInfo, partNumber)
+		writeChecksumHeaders(responseHeader, objectInfo.Metadata.ChecksumAlgorithm, checksum, checksumType)
+	}
+	applyResponseOverrides(responseHeader, queryParams)
+	responseHeader.Set("Content-Length", strconv.FormatInt(length, 10))
+	statusCode := http.StatusOK
+	if partial {
+		responseHeader.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size))
+		statusCode = http.StatusPartialContent
+	}
+	writeCommonHeaders(responseHeader)
+	w.WriteHeader(statusCode)
+	if content == nil {
+		return
+	}
+	_, err := io.Copy(w, io.NewSectionReader(content, start, length))
+	if err != nil {
+		logrus.Errorf("Cannot write object content: %s", err)
+	}
+}
+
+// objectErrorResponse writes an error for a GET object request, or only its status code for a HEAD request
+func objectErrorResponse(w http.ResponseWriter, r *http.Request, statusCode int, code, message string) {
+	if r.Method == http.MethodHead {
+		writeCommonHeaders(w.Header())
+		w.WriteHeader(statusCode)
+		return
+	}
+	writeXMLErrorResponse(w, statusCode, code, message)
+}
+
+// writeObjectHeaders writes the headers describing an object, shared by GET and HEAD so they always agree
+func writeObjectHeaders(w http.ResponseWriter, objectInfo *datastore.ObjectInfo) {
+	responseHeader := w.Header()
+	writeObjectMetadataHeaders(responseHeader, objectInfo.Metadata)
+	responseHeader.Set("Last-Modified", objectInfo.LastModified.UTC().Format(http.TimeFormat))
+	responseHeader.Set("Accept-Ranges", "bytes")
+	responseHeader.Set("ETag", quoteETag(objectInfo.Metadata.ETag))
+}
+
+// objectChecksum returns the checksum and checksum type of an object, or of one of its parts if partNumber is not 0
+func objectChecksum(objectInfo *datastore.ObjectInfo, partNumber int) (string, string) {
+	metadata := objectInfo.Metadata
+	if partNumber == 0 || len(metadata.PartChecksums) == 0 {
+		return metadata.Checksum, metadata.ChecksumType
+	}
+	if partNumber > len(metadata.PartChecksums) {
+		return "", ""
+	}
+	return metadata.PartChecksums[partNumber-1], ""
+}
+
+func applyResponseOverrides(responseHeader http.Header, queryParams url.Values) {
+	for param, header := range responseOverrides {
+		if value := queryParams.Get(param); value != "" {
+			responseHeader.Set(header, value)
+		}
+	}
+}
+
+// parseRange parses a Range header against the object size and returns the first byte and length of the range.
+// Like s3, multiple ranges and malformed headers are ignored and the whole object is served
+func parseRange(rangeHeader string, size int64) (int64, int64, rangeResult) {
+	if !strings.HasPrefix(rangeHeader, "bytes=") {
+		return 0, size, rangeIgnored
+	}
+	spec := strings.TrimSpace(strings.TrimPrefix(rangeHeader, "bytes="))
+	if strings.Contains(spec, ",") {
+		return 0, size, rangeIgnored
+	}
+	bounds := strings.SplitN(spec, "-", 2)
+	if len(bounds) != 2 {
+		return 0, size, rangeIgnored
+	}
+	if bounds[0] == "" {
+		suffixLength, err := strconv.ParseInt(bounds[1], 10, 64)
+		if err != nil || suffixLength < 0 {
+			return 0, size, rangeIgnored
+		}
+		if suffixLength == 0 || size == 0 {
+			return 0, 0, rangeNotSatisfiable
+		}
+		if suffixLength > size {
+			suffixLength = size
+		}
+		return size - suffixLength, suffixLength, rangeSatisfiable
+	}
+	first, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil || first < 0 {
+		return 0, size, rangeIgnored
+	}
+	last := size - 1
+	if bounds[1] != "" {
+		last, err = strconv.ParseInt(bounds[1], 10, 64)
+		if err != nil || last < first {
+			return 0, size, rangeIgnored
+		}
+	}
+	if first >= size {
+		return 0, 0, rangeNotSatisfiable
+	}
+	if last >= size {
+		last = size - 1
+	}
+	return first, last - first + 1, rangeSatisfiable
+}
+
+// partRange returns the first byte and length of a part of an object. Objects not uploaded in parts only have part 1
+func partRange(objectInfo *datastore.ObjectInfo, partNumber int) (int64, int64, bool) {
+	partSizes := objectInfo.Metadata.PartSizes
+	if len(partSizes) == 0 {
+		return 0, objectInfo.Size, partNumber == 1
+	}
+	if partNumber > len(partSizes) {
+		return 0, 0, false
+	}
+	start := int64(0)
+	for _, partSize := range partSizes[:partNumber-1] {
+		start += partSize
+	}
+	return start, partSizes[partNumber-1], true
+}
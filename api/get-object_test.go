@@ -0,0 +1,106 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/anduintransaction/fakes3/datastore"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		rangeHeader    string
+		size           int64
+		expectedStart  int64
+		expectedLength int64
+		expectedResult rangeResult
+	}{
+		{"bytes=0-9", 100, 0, 10, rangeSatisfiable},
+		{"bytes=10-10", 100, 10, 1, rangeSatisfiable},
+		{"bytes=90-", 100, 90, 10, rangeSatisfiable},
+		{"bytes=0-", 100, 0, 100, rangeSatisfiable},
+		{"bytes=90-200", 100, 90, 10, rangeSatisfiable},
+		{"bytes=-10", 100, 90, 10, rangeSatisfiable},
+		{"bytes=-200", 100, 0, 100, rangeSatisfiable},
+		{"bytes= 0-9", 100, 0, 10, rangeSatisfiable},
+		{"bytes=100-", 100, 0, 0, rangeNotSatisfiable},
+		{"bytes=100-200", 100, 0, 0, rangeNotSatisfiable},
+		{"bytes=-0", 100, 0, 0, rangeNotSatisfiable},
+		{"bytes=0-0", 0, 0, 0, rangeNotSatisfiable},
+		{"bytes=-10", 0, 0, 0, rangeNotSatisfiable},
+		{"bytes=0-9,20-29", 100, 0, 100, rangeIgnored},
+		{"bytes=9-0", 100, 0, 100, rangeIgnored},
+		{"bytes=a-9", 100, 0, 100, rangeIgnored},
+		{"bytes=0-b", 100, 0, 100, rangeIgnored},
+		{"bytes=--1", 100, 0, 100, rangeIgnored},
+		{"bytes=10", 100, 0, 100, rangeIgnored},
+		{"items=0-9", 100, 0, 100, rangeIgnored},
+		{"0-9", 100, 0, 100, rangeIgnored},
+	}
+	for _, test := range tests {
+		start, length, result := parseRange(test.rangeHeader, test.size)
+		if start != test.expectedStart || length != test.expectedLength || result != test.expectedResult {
+			t.Errorf("Range %q of %d bytes is start %d length %d result %d, expecting start %d length %d result %d",
+				test.rangeHeader, test.size, start, length, result, test.expectedStart, test.expectedLength, test.expectedResult)
+		}
+	}
+}
+
+func TestPartRange(t *testing.T) {
+	multipartObject := &datastore.ObjectInfo{Size: 12, Metadata: &datastore.ObjectMetadata{PartSizes: []int64{5, 5, 2}}}
+	singleObject := &datastore.ObjectInfo{Size: 12, Metadata: &datastore.ObjectMetadata{}}
+	tests := []struct {
+		objectInfo     *datastore.ObjectInfo
+		partNumber     int
+		expectedStart  int64
+		expectedLength int64
+		expectedOK     bool
+	}{
+		{multipartObject, 1, 0, 5, true},
+		{multipartObject, 2, 5, 5, true},
+		{multipartObject, 3, 10, 2, true},
+		{multipartObject, 4, 0, 0, false},
+		{singleObject, 1, 0, 12, true},
+		{singleObject, 2, 0, 12, false},
+	}
+	for _, test := range tests {
+		start, length, ok := partRange(test.objectInfo, test.partNumber)
+		if start != test.expectedStart || length != test.expectedLength || ok != test.expectedOK {
+			t.Errorf("Part %d of %v is start %d length %d %v, expecting start %d length %d %v",
+				test.partNumber, test.objectInfo.Metadata.PartSizes, start, length, ok, test.expectedStart, test.expectedLength, test.expectedOK)
+		}
+	}
+}
+
+func TestGetObjectRange(t *testing.T) {
+	s, cleanup := newTestServer(t, false)
+	defer cleanup()
+	putTestObject(t, s, "key", "content")
+	tests := []struct {
+		rangeHeader          string
+		expectedStatus       int
+		expectedContentRange string
+		expectedBody         string
+	}{
+		{"bytes=0-2", http.StatusPartialContent, "bytes 0-2/7", "con"},
+		{"bytes=4-", http.StatusPartialContent, "bytes 4-6/7", "ent"},
+		{"bytes=-3", http.StatusPartialContent, "bytes 4-6/7", "ent"},
+		{"bytes=5-100", http.StatusPartialContent, "bytes 5-6/7", "nt"},
+		{"bytes=7-", http.StatusRequestedRangeNotSatisfiable, "bytes */7", ""},
+		{"bytes=0-1,3-4", http.StatusOK, "", "content"},
+		{"bytes=3-1", http.StatusOK, "", "content"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/"+testBucket+"/key", nil)
+		r.Header.Set("Range", test.rangeHeader)
+		w := serveTestRequest(s, r)
+		if w.Code != test.expectedStatus || w.Header().Get("Content-Range") != test.expectedContentRange {
+			t.Errorf("Range %q returned %d with content range %q: %s", test.rangeHeader, w.Code, w.Header().Get("Content-Range"), w.Body.String())
+			continue
+		}
+		if test.expectedBody != "" && w.Body.String() != test.expectedBody {
+			t.Errorf("Range %q returned %q, expecting %q", test.rangeHeader, w.Body.String(), test.expectedBody)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/anduintransaction/fakes3/datastore"
+	"goji.io/pat"
+)
+
+const defaultMaxKeys = 1000
+
+type listObjectsContent struct {
+	Key          string        `xml:"Key"`
+	LastModified string        `xml:"LastModified"`
+	ETag         string        `xml:"ETag"`
+	Size         int64         `xml:"Size"`
+	StorageClass string        `xml:"StorageClass"`
+	Owner        *xmlPrincipal `xml:"Owner,omitempty"`
+}
+
+type listCommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type listBucketV2Result struct {
+	XMLName               xml.Name              `xml:"ListBucketResult"`
+	Xmlns                 string                `xml:"xmlns,attr"`
+	Name                  string                `xml:"Name"`
+	Prefix                string                `xml:"Prefix"`
+	Delimiter             string                `xml:"Delimiter,omitempty"`
+	MaxKeys               int                   `xml:"MaxKeys"`
+	EncodingType          string                `xml:"EncodingType,omitempty"`
+	KeyCount              int                   `xml:"KeyCount"`
+	IsTruncated           bool                  `xml:"IsTruncated"`
+	ContinuationToken     string                `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string                `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string                `xml:"StartAfter,omitempty"`
+	Contents              []*listObjectsContent `xml:"Contents"`
+	CommonPrefixes        []*listCommonPrefix   `xml:"CommonPrefixes"`
+}
+
+type listBucketV1Result struct {
+	XMLName        xml.Name              `xml:"ListBucketResult"`
+	Xmlns          string                `xml:"xmlns,attr"`
+	Name           string                `xml:"Name"`
+	Prefix         string                `xml:"Prefix"`
+	Marker         string                `xml:"Marker"`
+	NextMarker     string                `xml:"NextMarker,omitempty"`
+	MaxKeys        int                   `xml:"MaxKeys"`
+	Delimiter      string                `xml:"Delimiter,omitempty"`
+	EncodingType   string                `xml:"EncodingType,omitempty"`
+	IsTruncated    bool                  `xml:"IsTruncated"`
+	Contents       []*listObjectsContent `xml:"Contents"`
+	CommonPrefixes []*listCommonPrefix   `xml:"CommonPrefixes"`
+}
+
+// bucketListing is one page of a bucket listing, shared by all list apis
+type bucketListing struct {
+	contents       []*datastore.ObjectInfo
+	commonPrefixes []string
+	isTruncated    bool
+	lastEntry      string // last key or common prefix of the page, used as the next marker
+}
+
+// listBucket groups objects (already filtered by prefix and sorted) by delimiter and returns the page starting after marker
+func listBucket(objects []*datastore.ObjectInfo, prefix, delimiter, marker string, maxKeys int) *bucketListing {
+	listing := &bucketListing{}
+	if maxKeys == 0 {
+		return listing
+	}
+	count := 0
+	for _, object := range objects {
+		entry := object.Key
+		isCommonPrefix := false
+		if delimiter != "" {
+			if idx := strings.Index(object.Key[len(prefix):], delimiter); idx >= 0 {
+				entry = object.Key[:len(prefix)+idx+len(delimiter)]
+				isCommonPrefix = true
+			}
+		}
+		if object.Key <= marker {
+			continue
+		}
+		// A common prefix is listed once: a common prefix used as marker was listed by the previous page
+		if isCommonPrefix && (entry == marker || entry == listing.lastEntry) {
+			continue
+		}
+		if count >= maxKeys {
+			listing.isTruncated = true
+			break
+		}
+		if isCommonPrefix {
+			listing.commonPrefixes = append(listing.commonPrefixes, entry)
+		} else {
+			listing.contents = append(listing.contents, object)
+		}
+		listing.lastEntry = entry
+		count++
+	}
+	return listing
+}
+
+func (s *Server) listObjectsV2(w http.ResponseWriter, r *http.Request) {
+	bucket := pat.Param(r, "bucket")
+	queryParams := r.URL.Query()
+	prefix := queryParams.Get("prefix")
+	delimiter := queryParams.Get("delimiter")
+	startAfter := queryParams.Get("start-after")
+	continuationToken := queryParams.Get("continuation-token")
+	encodingType := queryParams.Get("encoding-type")
+	logrus.Debugf("Listing objects v2 in bucket %q, prefix %q, delimiter %q", bucket, prefix, delimiter)
+	maxKeys, ok := parseMaxKeys(w, queryParams)
+	if !ok {
+		return
+	}
+	if !validateEncodingType(w, encodingType) {
+		return
+	}
+	marker := startAfter
+	if queryKeyExists(queryParams, "continuation-token") {
+		decodedToken, err := base64.StdEncoding.DecodeString(continuationToken)
+		if err != nil {
+			writeXMLErrorResponse(w, http.StatusBadRequest, "InvalidArgument", "The continuation token provided is incorrect")
+			return
+		}
+		marker = string(decodedToken)
+	}
+	objects, err := s.objectStorage.ListObjects(bucket, prefix)
+	if err != nil {
+		storageErrorResponse(w, err)
+		return
+	}
+	listing := listBucket(objects, prefix, delimiter, marker, maxKeys)
+	encode := listEncoder(encodingType)
+	// ListObjectsV2 only returns owners when asked to
+	var owner *xmlPrincipal
+	if queryParams.Get("fetch-owner") == "true" {
+		owner = newXMLPrincipal(s.callerIdentity(r).Owner())
+	}
+	result := &listBucketV2Result{
+		Xmlns:             defaultResponseNamespace,
+		Name:              bucket,
+		Prefix:            encode(prefix),
+		Delimiter:         encode(delimiter),
+		MaxKeys:           maxKeys,
+		EncodingType:      encodingType,
+		KeyCount:          len(listing.contents) + len(listing.commonPrefixes),
+		IsTruncated:       listing.isTruncated,
+		ContinuationToken: continuationToken,
+		StartAfter:        encode(startAfter),
+		Contents:          toListObjectsContents(listing.contents, encode, owner),
+		CommonPrefixes:    toListCommonPrefixes(listing.commonPrefixes, encode),
+	}
+	if listing.isTruncated {
+		result.NextContinuationToken = base64.StdEncoding.EncodeToString([]byte(listing.lastEntry))
+	}
+	err = writeXMLResponse(w, result)
+	if err != nil {
+		logrus.Error(err)
+		errorResponse(w)
+	}
+}
+
+func (s *Server) listObjectsV1(w http.ResponseWriter, r *http.Request) {
+	bucket := pat.Param(r, "bucket")
+	queryParams := r.URL.Query()
+	prefix := queryParams.Get("prefix")
+	delimiter := queryParams.Get("delimiter")
+	marker := queryParams.Get("marker")
+	encodingType := queryParams.Get("encoding-type")
+	logrus.Debugf("Listing objects in bucket %q, prefix %q, delimiter %q, marker %q", bucket, prefix, delimiter, marker)
+	maxKeys, ok := parseMaxKeys(w, queryParams)
+	if !ok {
+		return
+	}
+	if !validateEncodingType(w, encodingType) {
+		return
+	}
+	objects, err := s.objectStorage.ListObjects(bucket, prefix)
+	if err != nil {
+		storageErrorResponse(w, err)
+		return
+	}
+	listing := listBucket(objects, prefix, delimiter, marker, maxKeys)
+	encode := listEncoder(encodingType)
+	result := &listBucketV1Result{
+		Xmlns:          defaultResponseNamespace,
+		Name:           bucket,
+		Prefix:         encode(prefix),
+		Marker:         encode(marker),
+		MaxKeys:        maxKeys,
+		Delimiter:      encode(delimiter),
+		EncodingType:   encodingType,
+		IsTruncated:    listing.isTruncated,
+		Contents:       toListObjectsContents(listing.contents, encode, newXMLPrincipal(s.callerIdentity(r).Owner())),
+		CommonPrefixes: toListCommonPrefixes(listing.commonPrefixes, encode),
+	}
+	// S3 only returns NextMarker when a delimiter is given, otherwise clients use the last key as the next marker
+	if listing.isTruncated && delimiter != "" {
+		result.NextMarker = encode(listing.lastEntry)
+	}
+	err = writeXMLResponse(w, result)
+	if err != nil {
+		logrus.Error(err)
+		errorResponse(w)
+	}
+}
+
+func parseMaxKeys(w http.ResponseWriter, queryParams url.Values) (int, bool) {
+	if !queryKeyExists(queryParams, "max-keys") {
+		return defaultMaxKeys, true
+	}
+	maxKeys, err := strconv.Atoi(queryParams.Get("max-keys"))
+	if err != nil || maxKeys < 0 {
+		writeXMLErrorResponse(w, http.StatusBadRequest, "InvalidArgument", "Provided max-keys not an integer or within integer range")
+		return 0, false
+	}
+	if maxKeys > defaultMaxKeys {
+		maxKeys = defaultMaxKeys
+	}
+	return maxKeys, true
+}
+
+func validateEncodingType(w http.ResponseWriter, encodingType string) bool {
+	if encodingType != "" && encodingType != "url" {
+		writeXMLErrorResponse(w, http.StatusBadRequest, "InvalidArgument", "Invalid Encoding Method specified in Request")
+		return false
+	}
+	return true
+}
+
+// listEncoder returns the function used to encode keys and prefixes in listing responses
+func listEncoder(encodingType string) func(string) string {
+	if encodingType != "url" {
+		return func(value string) string {
+			return value
+		}
+	}
+	return func(value string) string {
+		return strings.Replace(url.QueryEscape(value), "%2F", "/", -1)
+	}
+}
+
+// toListObjectsContents returns the contents of a listing, with owner unless it is nil
+func toListObjectsContents(objects []*datastore.ObjectInfo, encode func(string) string, owner *xmlPrincipal) []*listObjectsContent {
+	contents := make([]*listObjectsContent, 0, len(objects))
+	for _, object := range objects {
+		contents = append(contents, &listObjectsContent{
+			Key:          encode(object.Key),
+			LastModified: object.LastModified.UTC().Format(s3TimeFormat),
+			ETag:         quoteETag(object.Metadata.ETag),
+			Size:         object.Size,
+			StorageClass: "STANDARD",
+			Owner:        owner,
+		})
+	}
+	return contents
+}
+
+func toListCommonPrefixes(prefixes []string, encode func(string) string) []*listCommonPrefix {
+	commonPrefixes := make([]*listCommonPrefix, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		commonPrefixes = append(commonPrefixes, &listCommonPrefix{
+			Prefix: encode(prefix),
+		})
+	}
+	return commonPrefixes
+}
@@ -0,0 +1,182 @@
+package api
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/anduintransaction/fakes3/datastore"
+)
+
+var testListedKeys = []string{"a/b", "a/c", "a/d/e", "b", "c/x", "d"}
+
+// listingEntries returns the keys and common prefixes of a listing in listing order
+func listingEntries(contents []string, commonPrefixes []string) []string {
+	entries := append(append([]string{}, contents...), commonPrefixes...)
+	sort.Strings(entries)
+	return entries
+}
+
+func TestListBucket(t *testing.T) {
+	objects := []*datastore.ObjectInfo{}
+	for _, objectKey := range testListedKeys {
+		objects = append(objects, &datastore.ObjectInfo{Key: objectKey})
+	}
+	tests := []struct {
+		prefix    string
+		delimiter string
+		marker    string
+		maxKeys   int
+		expected  []string
+		truncated bool
+	}{
+		{"", "", "", 1000, testListedKeys, false},
+		{"", "", "a/c", 1000, []string{"a/d/e", "b", "c/x", "d"}, false},
+		{"", "", "", 2, []string{"a/b", "a/c"}, true},
+		{"", "/", "", 1000, []string{"a/", "b", "c/", "d"}, false},
+		{"", "/", "a", 1000, []string{"a/", "b", "c/", "d"}, false},
+		{"", "/", "a/", 1000, []string{"b", "c/", "d"}, false},
+		{"", "/", "a/b", 1000, []string{"a/", "b", "c/", "d"}, false},
+		{"", "/", "a/d/e", 1000, []string{"b", "c/", "d"}, false},
+		{"", "/", "c/a", 1000, []string{"c/", "d"}, false},
+		{"", "/", "c/x", 1000, []string{"d"}, false},
+		{"", "/", "", 2, []string{"a/", "b"}, true},
+		{"", "/", "", 4, []string{"a/", "b", "c/", "d"}, false},
+		{"a/", "/", "", 1000, []string{"a/b", "a/c", "a/d/"}, false},
+		{"a/", "/", "a/b", 1000, []string{"a/c", "a/d/"}, false},
+		{"a/", "/", "a/d/", 1000, []string{}, false},
+		{"", "/", "", 0, []string{}, false},
+	}
+	for _, test := range tests {
+		filtered := []*datastore.ObjectInfo{}
+		for _, object := range objects {
+			if strings.HasPrefix(object.Key, test.prefix) {
+				filtered = append(filtered, object)
+			}
+		}
+		listing := listBucket(filtered, test.prefix, test.delimiter, test.marker, test.maxKeys)
+		contents := []string{}
+		for _, object := range listing.contents {
+			contents = append(contents, object.Key)
+		}
+		entries := listingEntries(contents, listing.commonPrefixes)
+		if !reflect.DeepEqual(entries, test.expected) || listing.isTruncated != test.truncated {
+			t.Errorf("Listing prefix %q delimiter %q marker %q max keys %d returned %q truncated %v, expecting %q truncated %v",
+				test.prefix, test.delimiter, test.marker, test.maxKeys, entries, listing.isTruncated, test.expected, test.truncated)
+		}
+	}
+}
+
+// listTestBucket sends a listing request and decodes its response into result
+func listTestBucket(t *testing.T, s *Server, query url.Values, result interface{}) {
+	w := serveTestRequest(s, httptest.NewRequest(http.MethodGet, "/"+testBucket+"?"+query.Encode(), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Listing %q returned %d: %s", query.Encode(), w.Code, w.Body.String())
+	}
+	err := xml.Unmarshal(w.Body.Bytes(), result)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func listedEntries(contents []*listObjectsContent, commonPrefixes []*listCommonPrefix) []string {
+	keys := []string{}
+	for _, content := range contents {
+		keys = append(keys, content.Key)
+	}
+	prefixes := []string{}
+	for _, commonPrefix := range commonPrefixes {
+		prefixes = append(prefixes, commonPrefix.Prefix)
+	}
+	return listingEntries(keys, prefixes)
+}
+
+func TestListObjectsPaging(t *testing.T) {
+	s, cleanup := newTestServer(t, false)
+	defer cleanup()
+	for _, objectKey := range testListedKeys {
+		putTestObject(t, s, objectKey, "content")
+	}
+	tests := []struct {
+		delimiter string
+		expected  []string
+	}{
+		{"", testListedKeys},
+		{"/", []string{"a/", "b", "c/", "d"}},
+	}
+	for _, test := range tests {
+		for _, maxKeys := range []int{1, 2, 3} {
+			listed := []string{}
+			query := url.Values{"list-type": {"2"}, "delimiter": {test.delimiter}, "max-keys": {fmt.Sprint(maxKeys)}}
+			for page := 0; ; page++ {
+				if page > len(testListedKeys) {
+					t.Fatalf("Paging with continuation tokens does not end")
+				}
+				result := &listBucketV2Result{}
+				listTestBucket(t, s, query, result)
+				listed = append(listed, listedEntries(result.Contents, result.CommonPrefixes)...)
+				if !result.IsTruncated {
+					break
+				}
+				query.Set("continuation-token", result.NextContinuationToken)
+			}
+			if !reflect.DeepEqual(listed, test.expected) {
+				t.Errorf("Paging v2 with delimiter %q and max-keys %d listed %q, expecting %q", test.delimiter, maxKeys, listed, test.expected)
+			}
+
+			listed = []string{}
+			query = url.Values{"delimiter": {test.delimiter}, "max-keys": {fmt.Sprint(maxKeys)}}
+			for page := 0; ; page++ {
+				if page > len(testListedKeys) {
+					t.Fatalf("Paging with markers does not end")
+				}
+				result := &listBucketV1Result{}
+				listTestBucket(t, s, query, result)
+				entries := listedEntries(result.Contents, result.CommonPrefixes)
+				listed = append(listed, entries...)
+				if !result.IsTruncated {
+					break
+				}
+				nextMarker := result.NextMarker
+				if nextMarker == "" {
+					nextMarker = entries[len(entries)-1]
+				}
+				query.Set("marker", nextMarker)
+			}
+			if !reflect.DeepEqual(listed, test.expected) {
+				t.Errorf("Paging v1 with delimiter %q and max-keys %d listed %q, expecting %q", test.delimiter, maxKeys, listed, test.expected)
+			}
+		}
+	}
+}
+
+func TestListObjectsV2StartAfter(t *testing.T) {
+	s, cleanup := newTestServer(t, false)
+	defer cleanup()
+	for _, objectKey := range testListedKeys {
+		putTestObject(t, s, objectKey, "content")
+	}
+	tests := []struct {
+		startAfter string
+		expected   []string
+	}{
+		{"a/b", []string{"a/", "b", "c/", "d"}},
+		{"a/d/e", []string{"b", "c/", "d"}},
+		{"b", []string{"c/", "d"}},
+		{"z", []string{}},
+	}
+	for _, test := range tests {
+		result := &listBucketV2Result{}
+		listTestBucket(t, s, url.Values{"list-type": {"2"}, "delimiter": {"/"}, "start-after": {test.startAfter}}, result)
+		listed := listedEntries(result.Contents, result.CommonPrefixes)
+		if !reflect.DeepEqual(listed, test.expected) || result.StartAfter != test.startAfter {
+			t.Errorf("Listing after %q returned %q start after %q, expecting %q", test.startAfter, listed, result.StartAfter, test.expected)
+		}
+	}
+}
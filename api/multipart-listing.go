@@ -0,0 +1,269 @@
+package api
+
+import (
+	"encoding/xml"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/anduintransaction/fakes3/datastore"
+	"goji.io/pat"
+	"goji.io/pattern"
+)
+
+const defaultMaxParts = 1000
+
+type listPartsResult struct {
+	XMLName              xml.Name         `xml:"ListPartsResult"`
+	Xmlns                string           `xml:"xmlns,attr"`
+	Bucket               string           `xml:"Bucket"`
+	Key                  string           `xml:"Key"`
+	UploadID             string           `xml:"UploadId"`
+	Initiator            *xmlPrincipal    `xml:"Initiator"`
+	Owner                *xmlPrincipal    `xml:"Owner"`
+	StorageClass         string           `xml:"StorageClass"`
+	PartNumberMarker     int              `xml:"PartNumberMarker"`
+	NextPartNumberMarker int              `xml:"NextPartNumberMarker"`
+	MaxParts             int              `xml:"MaxParts"`
+	IsTruncated          bool             `xml:"IsTruncated"`
+	Parts                []*listPartsItem `xml:"Part"`
+}
+
+type listPartsItem struct {
+	PartNumber   int    `xml:"PartNumber"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	xmlChecksum
+}
+
+type listMultipartUploadsResult struct {
+	XMLName            xml.Name            `xml:"ListMultipartUploadsResult"`
+	Xmlns              string              `xml:"xmlns,attr"`
+	Bucket             string              `xml:"Bucket"`
+	KeyMarker          string              `xml:"KeyMarker"`
+	UploadIDMarker     string              `xml:"UploadIdMarker"`
+	NextKeyMarker      string              `xml:"NextKeyMarker"`
+	NextUploadIDMarker string              `xml:"NextUploadIdMarker"`
+	Delimiter          string              `xml:"Delimiter,omitempty"`
+	Prefix             string              `xml:"Prefix"`
+	EncodingType       string              `xml:"EncodingType,omitempty"`
+	MaxUploads         int                 `xml:"MaxUploads"`
+	IsTruncated        bool                `xml:"IsTruncated"`
+	Uploads            []*listUploadsItem  `xml:"Upload"`
+	CommonPrefixes     []*listCommonPrefix `xml:"CommonPrefixes"`
+}
+
+type listUploadsItem struct {
+	Key          string        `xml:"Key"`
+	UploadID     string        `xml:"UploadId"`
+	Initiator    *xmlPrincipal `xml:"Initiator"`
+	Owner        *xmlPrincipal `xml:"Owner"`
+	StorageClass string        `xml:"StorageClass"`
+	Initiated    string        `xml:"Initiated"`
+}
+
+func (s *Server) listParts(w http.ResponseWriter, r *http.Request) {
+	bucket := pat.Param(r, "bucket")
+	objectKey := extractObjectKeyFromPath(pattern.Path(r.Context()))
+	queryParams := r.URL.Query()
+	uploadID := queryParams.Get("uploadId")
+	logrus.Debugf("Listing parts of upload %q, bucket %q, key %q", uploadID, bucket, objectKey)
+	maxParts := defaultMaxParts
+	if queryKeyExists(queryParams, "max-parts") {
+		var err error
+		maxParts, err = strconv.Atoi(queryParams.Get("max-parts"))
+		if err != nil || maxParts < 0 {
+			writeXMLErrorResponse(w, http.StatusBadRequest, "InvalidArgument", "Provided max-parts not an integer or within integer range")
+			return
+		}
+		if maxParts > defaultMaxParts {
+			maxParts = defaultMaxParts
+		}
+	}
+	partNumberMarker := 0
+	if queryKeyExists(queryParams, "part-number-marker") {
+		var err error
+		partNumberMarker, err = strconv.Atoi(queryParams.Get("part-number-marker"))
+		if err != nil || partNumberMarker < 0 {
+			writeXMLErrorResponse(w, http.StatusBadRequest, "InvalidArgument", "Provided part-number-marker not an integer or within integer range")
+			return
+		}
+	}
+	parts, err := s.partStorage.ListParts(bucket, objectKey, uploadID)
+	if err != nil {
+		storageErrorResponse(w, err)
+		return
+	}
+	upload, err := s.partStorage.GetUpload(bucket, objectKey, uploadID)
+	if err != nil {
+		storageErrorResponse(w, err)
+		return
+	}
+	initiator, owner := uploadPrincipals(upload, s.callerIdentity(r))
+	result := &listPartsResult{
+		Xmlns:            defaultResponseNamespace,
+		Bucket:           bucket,
+		Key:              objectKey,
+		UploadID:         uploadID,
+		Initiator:        initiator,
+		Owner:            owner,
+		StorageClass:     "STANDARD",
+		PartNumberMarker: partNumberMarker,
+		MaxParts:         maxParts,
+		Parts:            []*listPartsItem{},
+	}
+	for _, part := range parts {
+		if part.PartNumber <= partNumberMarker {
+			continue
+		}
+		if len(result.Parts) >= maxParts {
+			result.IsTruncated = true
+			break
+		}
+		result.Parts = append(result.Parts, &listPartsItem{
+			PartNumber:   part.PartNumber,
+			LastModified: part.LastModified.UTC().Format(s3TimeFormat),
+			ETag:         quoteETag(part.ETag),
+			Size:         part.Size,
+			xmlChecksum:  newXMLChecksum(part.ChecksumAlgorithm, part.Checksum, ""),
+		})
+		result.NextPartNumberMarker = part.PartNumber
+	}
+	err = writeXMLResponse(w, result)
+	if err != nil {
+		logrus.Error(err)
+		errorResponse(w)
+	}
+}
+
+func (s *Server) listMultipartUploads(w http.ResponseWriter, r *http.Request) {
+	bucket := pat.Param(r, "bucket")
+	queryParams := r.URL.Query()
+	prefix := queryParams.Get("prefix")
+	delimiter := queryParams.Get("delimiter")
+	keyMarker := queryParams.Get("key-marker")
+	uploadIDMarker := queryParams.Get("upload-id-marker")
+	encodingType := queryParams.Get("encoding-type")
+	logrus.Debugf("Listing multipart uploads in bucket %q, prefix %q, delimiter %q", bucket, prefix, delimiter)
+	maxUploads := defaultMaxKeys
+	if queryKeyExists(queryParams, "max-uploads") {
+		var err error
+		maxUploads, err = strconv.Atoi(queryParams.Get("max-uploads"))
+		if err != nil || maxUploads < 0 {
+			writeXMLErrorResponse(w, http.StatusBadRequest, "InvalidArgument", "Provided max-uploads not an integer or within integer range")
+			return
+		}
+		if maxUploads > defaultMaxKeys {
+			maxUploads = defaultMaxKeys
+		}
+	}
+	if !validateEncodingType(w, encodingType) {
+		return
+	}
+	_, err := s.bucketStorage.GetBucket(bucket)
+	if err != nil {
+		storageErrorResponse(w, err)
+		return
+	}
+	uploads, err := s.partStorage.ListUploads(bucket)
+	if err != nil {
+		storageErrorResponse(w, err)
+		return
+	}
+	caller := s.callerIdentity(r)
+	encode := listEncoder(encodingType)
+	result := &listMultipartUploadsResult{
+		Xmlns:          defaultResponseNamespace,
+		Bucket:         bucket,
+		KeyMarker:      encode(keyMarker),
+		UploadIDMarker: uploadIDMarker,
+		Delimiter:      encode(delimiter),
+		Prefix:         encode(prefix),
+		EncodingType:   encodingType,
+		MaxUploads:     maxUploads,
+		Uploads:        []*listUploadsItem{},
+		CommonPrefixes: []*listCommonPrefix{},
+	}
+	uploads = uploadsAfterMarker(uploads, keyMarker, uploadIDMarker)
+	lastCommonPrefix := ""
+	for _, upload := range uploads {
+		if !strings.HasPrefix(upload.Key, prefix) {
+			continue
+		}
+		commonPrefix := ""
+		if delimiter != "" {
+			if idx := strings.Index(upload.Key[len(prefix):], delimiter); idx >= 0 {
+				commonPrefix = upload.Key[:len(prefix)+idx+len(delimiter)]
+			}
+		}
+		// A common prefix used as key marker also skips every upload rolled up into it
+		if commonPrefix != "" && (commonPrefix == lastCommonPrefix || commonPrefix <= keyMarker) {
+			continue
+		}
+		if len(result.Uploads)+len(result.CommonPrefixes) >= maxUploads {
+			result.IsTruncated = true
+			break
+		}
+		if commonPrefix != "" {
+			result.CommonPrefixes = append(result.CommonPrefixes, &listCommonPrefix{
+				Prefix: encode(commonPrefix),
+			})
+			lastCommonPrefix = commonPrefix
+			result.NextKeyMarker = encode(commonPrefix)
+			result.NextUploadIDMarker = ""
+			continue
+		}
+		initiator, owner := uploadPrincipals(upload, caller)
+		result.Uploads = append(result.Uploads, &listUploadsItem{
+			Key:          encode(upload.Key),
+			UploadID:     upload.UploadID,
+			Initiator:    initiator,
+			Owner:        owner,
+			StorageClass: "STANDARD",
+			Initiated:    upload.Initiated.UTC().Format(s3TimeFormat),
+		})
+		result.NextKeyMarker = encode(upload.Key)
+		result.NextUploadIDMarker = upload.UploadID
+	}
+	err = writeXMLResponse(w, result)
+	if err != nil {
+		logrus.Error(err)
+		errorResponse(w)
+	}
+}
+
+// uploadPrincipals returns the Initiator and Owner elements of an upload, the caller being both for uploads initiated by older versions
+func uploadPrincipals(upload *datastore.UploadInfo, caller *datastore.Identity) (*xmlPrincipal, *xmlPrincipal) {
+	initiator, owner := upload.InitiatorPrincipal, upload.Owner
+	if initiator == nil || owner == nil {
+		initiator, owner = caller.Initiator(), caller.Owner()
+	}
+	return newXMLPrincipal(initiator), newXMLPrincipal(owner)
+}
+
+// uploadsAfterMarker returns the uploads (sorted by key, initiation time then upload id) listed after the given key and upload id markers.
+// Without upload id marker, every upload of the marker key is skipped. Upload ids are random, so the upload id marker is skipped
+// through by its position. If that upload is gone, every upload of the marker key is returned rather than risking to miss some
+func uploadsAfterMarker(uploads []*datastore.UploadInfo, keyMarker, uploadIDMarker string) []*datastore.UploadInfo {
+	if keyMarker == "" {
+		return uploads
+	}
+	first := sort.Search(len(uploads), func(i int) bool {
+		return uploads[i].Key >= keyMarker
+	})
+	after := sort.Search(len(uploads), func(i int) bool {
+		return uploads[i].Key > keyMarker
+	})
+	if uploadIDMarker == "" {
+		return uploads[after:]
+	}
+	for i := first; i < after; i++ {
+		if uploads[i].UploadID == uploadIDMarker {
+			return uploads[i+1:]
+		}
+	}
+	return uploads[first:]
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/anduintransaction/fakes3/datastore"
+)
+
+func TestListMultipartUploadsPaging(t *testing.T) {
+	s, cleanup := newTestServer(t, false)
+	defer cleanup()
+	expected := []string{}
+	for _, objectKey := range []string{"a", "key", "key", "key", "key", "key", "z"} {
+		upload, err := s.partStorage.CreateUpload(testBucket, objectKey, "", datastore.DefaultIdentity(), &datastore.ObjectMetadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, objectKey+"/"+upload.UploadID)
+	}
+	for _, maxUploads := range []int{1, 2, 3} {
+		listed := []string{}
+		query := url.Values{"uploads": {""}, "max-uploads": {fmt.Sprint(maxUploads)}}
+		for page := 0; ; page++ {
+			if page > len(expected) {
+				t.Fatalf("Paging with max-uploads %d does not end", maxUploads)
+			}
+			w := serveTestRequest(s, httptest.NewRequest(http.MethodGet, "/"+testBucket+"?"+query.Encode(), nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("List uploads returned %d: %s", w.Code, w.Body.String())
+			}
+			result := &listMultipartUploadsResult{}
+			err := xml.Unmarshal(w.Body.Bytes(), result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, upload := range result.Uploads {
+				listed = append(listed, upload.Key+"/"+upload.UploadID)
+			}
+			if !result.IsTruncated {
+				break
+			}
+			query.Set("key-marker", result.NextKeyMarker)
+			query.Set("upload-id-marker", result.NextUploadIDMarker)
+		}
+		if !reflect.DeepEqual(listed, expected) {
+			t.Errorf("Paging with max-uploads %d listed %q, expecting %q", maxUploads, listed, expected)
+		}
+	}
+}
+
+func TestUploadsAfterMarker(t *testing.T) {
+	uploads := []*datastore.UploadInfo{
+		{Key: "a", UploadID: "3"},
+		{Key: "key", UploadID: "9"},
+		{Key: "key", UploadID: "1"},
+		{Key: "key", UploadID: "5"},
+		{Key: "z", UploadID: "2"},
+	}
+	tests := []struct {
+		keyMarker      string
+		uploadIDMarker string
+		expected       []string
+	}{
+		{"", "", []string{"3", "9", "1", "5", "2"}},
+		{"a", "", []string{"9", "1", "5", "2"}},
+		{"key", "", []string{"2"}},
+		{"key", "9", []string{"1", "5", "2"}},
+		{"key", "1", []string{"5", "2"}},
+		{"key", "5", []string{"2"}},
+		{"key", "gone", []string{"9", "1", "5", "2"}},
+		{"b", "", []string{"9", "1", "5", "2"}},
+		{"zz", "", []string{}},
+	}
+	for _, test := range tests {
+		uploadIDs := []string{}
+		for _, upload := range uploadsAfterMarker(uploads, test.keyMarker, test.uploadIDMarker) {
+			uploadIDs = append(uploadIDs, upload.UploadID)
+		}
+		if !reflect.DeepEqual(uploadIDs, test.expected) {
+			t.Errorf("Uploads after %q %q are %q, expecting %q", test.keyMarker, test.uploadIDMarker, uploadIDs, test.expected)
+		}
+	}
+}
@@ -2,15 +2,21 @@ package api
 
 import (
 	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/Sirupsen/logrus"
-	uuid "github.com/satori/go.uuid"
+	"github.com/anduintransaction/fakes3/datastore"
 	"goji.io/pat"
 	"goji.io/pattern"
 )
 
+const maxPartNumber = 10000
+
 type initializeMultipartUploadResult struct {
 	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
 	Xmlns    string   `xml:"xmlns,attr"`
@@ -25,17 +31,59 @@ type completeMultipartUploadResult struct {
 	Bucket   string   `xml:"Bucket"`
 	Key      string   `xml:"Key"`
 	ETag     string   `xml:"ETag"`
+	xmlChecksum
+}
+
+type copyPartResult struct {
+	XMLName      xml.Name `xml:"CopyPartResult"`
+	Xmlns        string   `xml:"xmlns,attr"`
+	LastModified string   `xml:"LastModified"`
+	ETag         string   `xml:"ETag"`
+	xmlChecksum
+}
+
+type completeMultipartUploadRequest struct {
+	XMLName xml.Name                `xml:"CompleteMultipartUpload"`
+	Parts   []*completeUploadedPart `xml:"Part"`
+}
+
+type completeUploadedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+	xmlChecksum
 }
 
 func (s *Server) initializeMultipartUpload(w http.ResponseWriter, r *http.Request) {
 	bucket := pat.Param(r, "bucket")
 	objectKey := extractObjectKeyFromPath(pattern.Path(r.Context()))
 	logrus.Debugf("Initialize multipart upload to object %q, bucket %q", objectKey, bucket)
-	err := writeXMLResponse(w, &initializeMultipartUploadResult{
+	metadata, ok := parseObjectMetadata(w, r.Header)
+	if !ok {
+		return
+	}
+	metadata.ChecksumAlgorithm, metadata.ChecksumType, ok = parseMultipartChecksum(w, r.Header)
+	if !ok {
+		return
+	}
+	err := s.bucketStorage.EnsureBucket(bucket)
+	if err != nil {
+		storageErrorResponse(w, err)
+		return
+	}
+	uploadInfo, err := s.partStorage.CreateUpload(bucket, objectKey, requestAccessKeyID(r), s.callerIdentity(r), metadata)
+	if err != nil {
+		storageErrorResponse(w, err)
+		return
+	}
+	if metadata.ChecksumAlgorithm != "" {
+		w.Header().Set("x-amz-checksum-algorithm", metadata.ChecksumAlgorithm)
+		w.Header().Set("x-amz-checksum-type", metadata.ChecksumType)
+	}
+	err = writeXMLResponse(w, &initializeMultipartUploadResult{
 		Xmlns:    defaultResponseNamespace,
 		Bucket:   bucket,
 		Key:      objectKey,
-		UploadID: uuid.NewV4().String(),
+		UploadID: uploadInfo.UploadID,
 	})
 	if err != nil {
 		logrus.Error(err)
@@ -44,19 +92,77 @@ func (s *Server) initializeMultipartUpload(w http.ResponseWriter, r *http.Reques
 }
 
 func (s *Server) uploadPart(w http.ResponseWriter, r *http.Request) {
-	partNumber, err := strconv.ParseInt(r.URL.Query().Get("partNumber"), 10, 64)
-	if err != nil {
-		logrus.Error(err)
+	bucket := pat.Param(r, "bucket")
+	objectKey := extractObjectKeyFromPath(pattern.Path(r.Context()))
+	partNumber, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > maxPartNumber {
+		writeXMLErrorResponse(w, http.StatusBadRequest, "InvalidArgument", "Part number must be an integer between 1 and 10000, inclusive")
+		return
 	}
 	uploadID := r.URL.Query().Get("uploadId")
 	logrus.Debugf("Got part %d from %q", partNumber, uploadID)
-	err = s.partStorage.StorePart(uploadID, int(partNumber), r.Body)
+	payload, ok := parsePayload(w, r, r.Body, r.ContentLength)
+	if !ok {
+		return
+	}
+	partInfo, err := s.partStorage.StorePart(bucket, objectKey, uploadID, partNumber, payload)
+	if err != nil {
+		storageErrorResponse(w, err)
+		return
+	}
+	w.Header().Set("ETag", quoteETag(partInfo.ETag))
+	writeChecksumHeaders(w.Header(), partInfo.ChecksumAlgorithm, partInfo.Checksum, "")
+	writeEmptySuccessResponse(w)
+}
+
+func (s *Server) uploadPartCopy(w http.ResponseWriter, r *http.Request) {
+	bucket := pat.Param(r, "bucket")
+	objectKey := extractObjectKeyFromPath(pattern.Path(r.Context()))
+	partNumber, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > maxPartNumber {
+		writeXMLErrorResponse(w, http.StatusBadRequest, "InvalidArgument", "Part number must be an integer between 1 and 10000, inclusive")
+		return
+	}
+	uploadID := r.URL.Query().Get("uploadId")
+	sourceBucket, sourceKey, ok := parseCopySource(r.Header.Get("x-amz-copy-source"))
+	if !ok {
+		writeXMLErrorResponse(w, http.StatusBadRequest, "InvalidArgument", "Copy Source must mention the source bucket and key: sourcebucket/sourcekey")
+		return
+	}
+	logrus.Debugf("Copying part %d of %q from object %q, bucket %q", partNumber, uploadID, sourceKey, sourceBucket)
+	f, sourceInfo, err := s.objectStorage.OpenObject(sourceBucket, sourceKey)
+	if err != nil {
+		storageErrorResponse(w, err)
+		return
+	}
+	defer f.Close()
+	if !copySourceConditionsMet(r.Header, sourceInfo) {
+		preconditionFailedResponse(w)
+		return
+	}
+	first, last := int64(0), sourceInfo.Size-1
+	if copySourceRange := r.Header.Get("x-amz-copy-source-range"); copySourceRange != "" {
+		first, last, ok = parseCopySourceRange(copySourceRange, sourceInfo.Size)
+		if !ok {
+			writeXMLErrorResponse(w, http.StatusBadRequest, "InvalidArgument", fmt.Sprintf("Range specified is not valid for source object of size: %d", sourceInfo.Size))
+			return
+		}
+	}
+	partInfo, err := s.partStorage.StorePart(bucket, objectKey, uploadID, partNumber, datastore.NewPayload(io.NewSectionReader(f, first, last-first+1), last-first+1))
+	if err != nil {
+		storageErrorResponse(w, err)
+		return
+	}
+	err = writeXMLResponse(w, &copyPartResult{
+		Xmlns:        defaultResponseNamespace,
+		LastModified: partInfo.LastModified.UTC().Format(s3TimeFormat),
+		ETag:         quoteETag(partInfo.ETag),
+		xmlChecksum:  newXMLChecksum(partInfo.ChecksumAlgorithm, partInfo.Checksum, ""),
+	})
 	if err != nil {
 		logrus.Error(err)
 		errorResponse(w)
 	}
-	w.Header().Set("ETag", generateRandomETag())
-	writeEmptySuccessResponse(w)
 }
 
 func (s *Server) completeMultipartUpload(w http.ResponseWriter, r *http.Request) {
@@ -64,21 +170,67 @@ func (s *Server) completeMultipartUpload(w http.ResponseWriter, r *http.Request)
 	bucket := pat.Param(r, "bucket")
 	objectKey := extractObjectKeyFromPath(pattern.Path(r.Context()))
 	logrus.Debugf("Got complete multipart upload for %q, bucket %q, key %q", uploadID, bucket, objectKey)
-	err := s.objectStorage.MergeParts(bucket, objectKey, uploadID, s.partStorage)
+	parts, ok := parseCompletedParts(w, r)
+	if !ok {
+		return
+	}
+	metadata, err := s.objectStorage.MergeParts(bucket, objectKey, uploadID, parts, s.partStorage)
 	if err != nil {
-		logrus.Error(err)
-		errorResponse(w)
+		storageErrorResponse(w, err)
+		return
 	}
-	etag := generateRandomETag()
+	etag := quoteETag(metadata.ETag)
 	w.Header().Set("ETag", etag)
 	err = writeXMLResponse(w, &completeMultipartUploadResult{
-		Location: generateFullObjectPath(s.config.S3ApiServer.AdvertisedAddr, r, bucket, objectKey),
-		Bucket:   bucket,
-		Key:      objectKey,
-		ETag:     etag,
+		Location:    generateFullObjectPath(s.config.S3ApiServer.AdvertisedAddr, r, bucket, objectKey),
+		Bucket:      bucket,
+		Key:         objectKey,
+		ETag:        etag,
+		xmlChecksum: newXMLChecksum(metadata.ChecksumAlgorithm, metadata.Checksum, metadata.ChecksumType),
 	})
 	if err != nil {
 		logrus.Error(err)
 		errorResponse(w)
 	}
 }
+
+// parseCompletedParts parses the part list of a CompleteMultipartUpload request.
+// Returns false if the body is invalid, in which case an error has been written to the response
+func parseCompletedParts(w http.ResponseWriter, r *http.Request) ([]*datastore.CompletedPart, bool) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		logrus.Error(err)
+		errorResponse(w)
+		return nil, false
+	}
+	request := &completeMultipartUploadRequest{}
+	err = xml.Unmarshal(body, request)
+	if err != nil || len(request.Parts) == 0 {
+		logrus.Warnf("Invalid complete multipart upload request: %q", body)
+		malformedXMLResponse(w)
+		return nil, false
+	}
+	parts := make([]*datastore.CompletedPart, 0, len(request.Parts))
+	for _, part := range request.Parts {
+		parts = append(parts, &datastore.CompletedPart{
+			PartNumber: part.PartNumber,
+			ETag:       strings.Trim(part.ETag, "\""),
+			Checksum:   part.value(),
+		})
+	}
+	return parts, true
+}
+
+func (s *Server) abortMultipartUpload(w http.ResponseWriter, r *http.Request) {
+	uploadID := r.URL.Query().Get("uploadId")
+	bucket := pat.Param(r, "bucket")
+	objectKey := extractObjectKeyFromPath(pattern.Path(r.Context()))
+	logrus.Debugf("Aborting multipart upload %q, bucket %q, key %q", uploadID, bucket, objectKey)
+	err := s.partStorage.AbortUpload(bucket, objectKey, uploadID)
+	if err != nil {
+		storageErrorResponse(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	writeEmptySuccessResponse(w)
+}
@@ -11,25 +11,47 @@ import (
 
 // Server for s3 Api
 type Server struct {
-	Mux           http.Handler
-	config        *config.Config
-	partStorage   *datastore.PartStorage
-	objectStorage *datastore.ObjectStorage
+	Mux               http.Handler
+	config            *config.Config
+	bucketStorage     *datastore.BucketStorage
+	partStorage       *datastore.PartStorage
+	objectStorage     *datastore.ObjectStorage
+	credentialStorage *datastore.CredentialStorage
 }
 
 // NewServer returns a new S3 Api Server
-func NewServer(config *config.Config) *Server {
+func NewServer(config *config.Config) (*Server, error) {
+	err := datastore.CheckLayout(config.S3ApiServer.DataFolder)
+	if err != nil {
+		return nil, err
+	}
 	s := &Server{}
 	s.config = config
 	s.Mux = s.newMux()
+	s.bucketStorage = datastore.NewBucketStorage(s.config.S3ApiServer.DataFolder, s.config.S3ApiServer.AutoCreateBuckets)
 	s.partStorage = datastore.NewPartStorage(s.config.S3ApiServer.DataFolder)
-	s.objectStorage = datastore.NewObjectStorage(s.config.S3ApiServer.DataFolder)
-	return s
+	s.objectStorage = datastore.NewObjectStorage(s.config.S3ApiServer.DataFolder, s.bucketStorage)
+	s.credentialStorage = datastore.NewCredentialStorage(s.config.S3ApiServer.DataFolder)
+	err = s.bucketStorage.PreCreateBuckets(s.config.S3ApiServer.PreCreateBuckets)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
 }
 
 // Mux returns the HTTP handler for s3 Api
 func (s *Server) newMux() http.Handler {
 	mux := goji.NewMux()
+	mux.Use(s.authenticate)
+	mux.HandleFunc(pat.Get("/"), s.listBuckets)
+	for _, bucketPattern := range []string{"/:bucket", "/:bucket/"} {
+		mux.HandleFunc(pat.Head(bucketPattern), s.headBucket)
+		mux.HandleFunc(pat.Get(bucketPattern), s.getBucketRoute)
+		mux.HandleFunc(pat.Put(bucketPattern), s.createBucket)
+		mux.HandleFunc(pat.Post(bucketPattern), s.postBucketRoute)
+		mux.HandleFunc(pat.Delete(bucketPattern), s.deleteBucket)
+	}
+	mux.HandleFunc(pat.Head("/:bucket/*"), s.headObjectRoute)
 	mux.HandleFunc(pat.Get("/:bucket/*"), s.getObjectRoute)
 	mux.HandleFunc(pat.Post("/:bucket/*"), s.postObjectRoute)
 	mux.HandleFunc(pat.Put("/:bucket/*"), s.putObjectRoute)
@@ -12,11 +12,20 @@ func (s *Server) normalUpload(w http.ResponseWriter, r *http.Request) {
 	bucket := pat.Param(r, "bucket")
 	objectKey := extractObjectKeyFromPath(pattern.Path(r.Context()))
 	logrus.Debugf("Uploading object %q to bucket %q", objectKey, bucket)
-	err := s.objectStorage.PutObject(bucket, objectKey, r.Body)
+	metadata, ok := parseObjectMetadata(w, r.Header)
+	if !ok {
+		return
+	}
+	payload, ok := parsePayload(w, r, r.Body, r.ContentLength)
+	if !ok {
+		return
+	}
+	objectInfo, err := s.objectStorage.PutObject(bucket, objectKey, payload, metadata)
 	if err != nil {
-		logrus.Error(err)
-		errorResponse(w)
+		storageErrorResponse(w, err)
 		return
 	}
+	w.Header().Set("ETag", quoteETag(objectInfo.Metadata.ETag))
+	writeChecksumHeaders(w.Header(), objectInfo.Metadata.ChecksumAlgorithm, objectInfo.Metadata.Checksum, objectInfo.Metadata.ChecksumType)
 	writeEmptySuccessResponse(w)
 }
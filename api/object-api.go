@@ -9,18 +9,19 @@ import (
 )
 
 func (s *Server) getObjectRoute(w http.ResponseWriter, r *http.Request) {
-	bucket := pat.Param(r, "bucket")
-	objectKey := extractObjectKeyFromPath(pattern.Path(r.Context()))
-	logrus.Debugf("Getting object %q from bucket %q", objectKey, bucket)
-	objectPath := s.objectStorage.GetObjectFilePath(bucket, objectKey)
-	if objectPath == "" {
-		logrus.Warnf("Object not found or is not a file: %q", objectKey)
-		notFoundResponse(w, r)
-		return
+	queryParams := r.URL.Query()
+	switch {
+	case queryKeyExists(queryParams, "uploadId"):
+		s.listParts(w, r)
+	case queryKeyExists(queryParams, "attributes"):
+		s.getObjectAttributes(w, r)
+	default:
+		s.getObject(w, r)
 	}
-	addCORSHeaders(w)
-	w.Header().Add("Content-Type", "application/octet-stream")
-	http.ServeFile(w, r, objectPath)
+}
+
+func (s *Server) headObjectRoute(w http.ResponseWriter, r *http.Request) {
+	s.headObject(w, r)
 }
 
 func (s *Server) postObjectRoute(w http.ResponseWriter, r *http.Request) {
@@ -38,9 +39,13 @@ func (s *Server) postObjectRoute(w http.ResponseWriter, r *http.Request) {
 func (s *Server) putObjectRoute(w http.ResponseWriter, r *http.Request) {
 	queryParams := r.URL.Query()
 	switch {
+	case queryKeyExists(queryParams, "partNumber") && queryKeyExists(queryParams, "uploadId") && r.Header.Get("x-amz-copy-source") != "":
+		s.uploadPartCopy(w, r)
 	case queryKeyExists(queryParams, "partNumber") && queryKeyExists(queryParams, "uploadId"):
 		s.uploadPart(w, r)
-	case len(queryParams) == 0:
+	case !hasSubresource(queryParams) && r.Header.Get("x-amz-copy-source") != "":
+		s.copyObject(w, r)
+	case !hasSubresource(queryParams):
 		s.normalUpload(w, r)
 	default:
 		notFoundResponse(w, r)
@@ -48,13 +53,22 @@ func (s *Server) putObjectRoute(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) deleteObjectRoute(w http.ResponseWriter, r *http.Request) {
+	queryParams := r.URL.Query()
+	switch {
+	case queryKeyExists(queryParams, "uploadId"):
+		s.abortMultipartUpload(w, r)
+	default:
+		s.deleteObject(w, r)
+	}
+}
+
+func (s *Server) deleteObject(w http.ResponseWriter, r *http.Request) {
 	bucket := pat.Param(r, "bucket")
 	objectKey := extractObjectKeyFromPath(pattern.Path(r.Context()))
 	logrus.Debugf("Deleting object %q from bucket %q", objectKey, bucket)
 	err := s.objectStorage.DeleteObject(bucket, objectKey)
 	if err != nil {
-		logrus.Error(err)
-		errorResponse(w)
+		storageErrorResponse(w, err)
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"goji.io/pat"
+	"goji.io/pattern"
+)
+
+// objectAttributes lists the attributes that can be requested in the x-amz-object-attributes header
+var objectAttributes = map[string]bool{
+	"ETag":         true,
+	"Checksum":     true,
+	"ObjectParts":  true,
+	"StorageClass": true,
+	"ObjectSize":   true,
+}
+
+type getObjectAttributesResult struct {
+	XMLName      xml.Name              `xml:"GetObjectAttributesResponse"`
+	Xmlns        string                `xml:"xmlns,attr"`
+	ETag         string                `xml:"ETag,omitempty"`
+	Checksum     *xmlChecksum          `xml:"Checksum,omitempty"`
+	ObjectParts  *objectAttributeParts `xml:"ObjectParts,omitempty"`
+	StorageClass string                `xml:"StorageClass,omitempty"`
+	ObjectSize   *int64                `xml:"ObjectSize,omitempty"`
+}
+
+type objectAttributeParts struct {
+	IsTruncated          bool                   `xml:"IsTruncated"`
+	MaxParts             int                    `xml:"MaxParts"`
+	NextPartNumberMarker int                    `xml:"NextPartNumberMarker"`
+	PartNumberMarker     int                    `xml:"PartNumberMarker"`
+	Parts                []*objectAttributePart `xml:"Part"`
+	PartsCount           int                    `xml:"PartsCount"`
+}
+
+type objectAttributePart struct {
+	xmlChecksum
+	PartNumber int   `xml:"PartNumber"`
+	Size       int64 `xml:"Size"`
+}
+
+func (s *Server) getObjectAttributes(w http.ResponseWriter, r *http.Request) {
+	bucket := pat.Param(r, "bucket")
+	objectKey := extractObjectKeyFromPath(pattern.Path(r.Context()))
+	logrus.Debugf("Getting attributes of object %q from bucket %q", objectKey, bucket)
+	requested := map[string]bool{}
+	for _, attribute := range strings.Split(r.Header.Get("x-amz-object-attributes"), ",") {
+		attribute = strings.TrimSpace(attribute)
+		if attribute == "" {
+			continue
+		}
+		if !objectAttributes[attribute] {
+			writeXMLErrorResponse(w, http.StatusBadRequest, "InvalidArgument", "Invalid attribute name specified.")
+			return
+		}
+		requested[attribute] = true
+	}
+	if len(requested) == 0 {
+		writeXMLErrorResponse(w, http.StatusBadRequest, "InvalidRequest", "The x-amz-object-attributes header specifying the attributes to be retrieved is either missing or empty")
+		return
+	}
+	maxParts := defaultMaxParts
+	if maxPartsHeader := r.Header.Get("x-amz-max-parts"); maxPartsHeader != "" {
+		var err error
+		maxParts, err = strconv.Atoi(maxPartsHeader)
+		if err != nil || maxParts < 0 {
+			writeXMLErrorResponse(w, http.StatusBadRequest, "InvalidArgument", "Provided max-parts not an integer or within integer range")
+			return
+		}
+		if maxParts > defaultMaxParts {
+			maxParts = defaultMaxParts
+		}
+	}
+	partNumberMarker := 0
+	if partNumberMarkerHeader := r.Header.Get("x-amz-part-number-marker"); partNumberMarkerHeader != "" {
+		var err error
+		partNumberMarker, err = strconv.Atoi(partNumberMarkerHeader)
+		if err != nil || partNumberMarker < 0 {
+			writeXMLErrorResponse(w, http.StatusBadRequest, "InvalidArgument", "Provided part-number-marker not an integer or within integer range")
+			return
+		}
+	}
+	objectInfo, err := s.objectStorage.GetObjectInfo(bucket, objectKey)
+	if err != nil {
+		storageErrorResponse(w, err)
+		return
+	}
+	metadata := objectInfo.Metadata
+	result := &getObjectAttributesResult{
+		Xmlns: defaultResponseNamespace,
+	}
+	if requested["ETag"] {
+		result.ETag = metadata.ETag
+	}
+	if requested["Checksum"] && metadata.Checksum != "" {
+		checksum := newXMLChecksum(metadata.ChecksumAlgorithm, metadata.Checksum, metadata.ChecksumType)
+		result.Checksum = &checksum
+	}
+	if requested["ObjectParts"] && len(metadata.PartSizes) > 0 {
+		result.ObjectParts = &objectAttributeParts{
+			MaxParts:         maxParts,
+			PartNumberMarker: partNumberMarker,
+			Parts:            []*objectAttributePart{},
+			PartsCount:       len(metadata.PartSizes),
+		}
+		for i, partSize := range metadata.PartSizes {
+			partNumber := i + 1
+			if partNumber <= partNumberMarker {
+				continue
+			}
+			if len(result.ObjectParts.Parts) >= maxParts {
+				result.ObjectParts.IsTruncated = true
+				break
+			}
+			partChecksum, _ := objectChecksum(objectInfo, partNumber)
+			result.ObjectParts.Parts = append(result.ObjectParts.Parts, &objectAttributePart{
+				xmlChecksum: newXMLChecksum(metadata.ChecksumAlgorithm, partChecksum, ""),
+				PartNumber:  partNumber,
+				Size:        partSize,
+			})
+			result.ObjectParts.NextPartNumberMarker = partNumber
+		}
+	}
+	if requested["StorageClass"] {
+		result.StorageClass = "STANDARD"
+	}
+	if requested["ObjectSize"] {
+		result.ObjectSize = &objectInfo.Size
+	}
+	w.Header().Set("Last-Modified", objectInfo.LastModified.UTC().Format(http.TimeFormat))
+	err = writeXMLResponse(w, result)
+	if err != nil {
+		logrus.Error(err)
+		errorResponse(w)
+	}
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/anduintransaction/fakes3/datastore"
+)
+
+const (
+	userMetadataHeaderPrefix = "X-Amz-Meta-"
+	maxUserMetadataSize      = 2048
+	maxObjectTags            = 10
+	maxTagKeyLength          = 128
+	maxTagValueLength        = 256
+)
+
+// parseObjectMetadata extracts the metadata to store with an object from the request headers.
+// Returns false if the metadata is invalid, in which case an error has been written to the response
+func parseObjectMetadata(w http.ResponseWriter, requestHeader http.Header) (*datastore.ObjectMetadata, bool) {
+	metadata := &datastore.ObjectMetadata{
+		ContentType:        requestHeader.Get("Content-Type"),
+		ContentEncoding:    stripChunkedEncoding(requestHeader.Get("Content-Encoding")),
+		ContentDisposition: requestHeader.Get("Content-Disposition"),
+		ContentLanguage:    requestHeader.Get("Content-Language"),
+		CacheControl:       requestHeader.Get("Cache-Control"),
+		Expires:            requestHeader.Get("Expires"),
+		UserMetadata:       map[string]string{},
+	}
+	userMetadataSize := 0
+	for name, values := range requestHeader {
+		if !strings.HasPrefix(name, userMetadataHeaderPrefix) {
+			continue
+		}
+		key := strings.ToLower(strings.TrimPrefix(name, userMetadataHeaderPrefix))
+		value := strings.Join(values, ",")
+		metadata.UserMetadata[key] = value
+		userMetadataSize += len(key) + len(value)
+	}
+	if userMetadataSize > maxUserMetadataSize {
+		writeXMLErrorResponse(w, http.StatusBadRequest, "MetadataTooLarge", "Your metadata headers exceed the maximum allowed metadata size.")
+		return nil, false
+	}
+	tags, ok := parseObjectTags(w, requestHeader.Get("x-amz-tagging"))
+	if !ok {
+		return nil, false
+	}
+	metadata.Tags = tags
+	return metadata, true
+}
+
+// parseObjectTags parses the x-amz-tagging header, encoded as url query parameters.
+// Returns false if the tags are invalid, in which case an error has been written to the response
+func parseObjectTags(w http.ResponseWriter, tagging string) (map[string]string, bool) {
+	tags := map[string]string{}
+	if tagging == "" {
+		return tags, true
+	}
+	values, err := url.ParseQuery(tagging)
+	if err != nil {
+		writeXMLErrorResponse(w, http.StatusBadRequest, "InvalidArgument", "The header 'x-amz-tagging' shall be encoded as UTF-8 then URLEncoded URL query parameters without tag name duplicates.")
+		return nil, false
+	}
+	if len(values) > maxObjectTags {
+		writeXMLErrorResponse(w, http.StatusBadRequest, "InvalidTag", "Object tags cannot be greater than 10")
+		return nil, false
+	}
+	for key, value := range values {
+		if len(value) != 1 {
+			writeXMLErrorResponse(w, http.StatusBadRequest, "InvalidArgument", "The header 'x-amz-tagging' shall be encoded as UTF-8 then URLEncoded URL query parameters without tag name duplicates.")
+			return nil, false
+		}
+		if key == "" || len(key) > maxTagKeyLength || len(value[0]) > maxTagValueLength {
+			writeXMLErrorResponse(w, http.StatusBadRequest, "InvalidTag", "The TagKey or TagValue you have provided is too long or empty.")
+			return nil, false
+		}
+		tags[key] = value[0]
+	}
+	return tags, true
+}
+
+// writeObjectMetadataHeaders writes the stored metadata of an object to the response headers
+func writeObjectMetadataHeaders(responseHeader http.Header, metadata *datastore.ObjectMetadata) {
+	contentType := metadata.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	responseHeader.Set("Content-Type", contentType)
+	optionalHeaders := map[string]string{
+		"Content-Encoding":    metadata.ContentEncoding,
+		"Content-Disposition": metadata.ContentDisposition,
+		"Content-Language":    metadata.ContentLanguage,
+		"Cache-Control":       metadata.CacheControl,
+		"Expires":             metadata.Expires,
+	}
+	for name, value := range optionalHeaders {
+		if value != "" {
+			responseHeader.Set(name, value)
+		}
+	}
+	for key, value := range metadata.UserMetadata {
+		responseHeader.Set(userMetadataHeaderPrefix+key, value)
+	}
+	if len(metadata.Tags) > 0 {
+		responseHeader.Set("x-amz-tagging-count", strconv.Itoa(len(metadata.Tags)))
+	}
+}
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/anduintransaction/fakes3/datastore"
+)
+
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// parsePayload returns the payload of an upload request with the digests announced in its headers.
+// aws-chunked bodies are decoded, so the payload only provides the content sent by the client.
+// Returns false if a header is invalid, in which case an error has been written to the response
+func parsePayload(w http.ResponseWriter, r *http.Request, body io.Reader, size int64) (*datastore.Payload, bool) {
+	var chunked *chunkedReader
+	if isChunkedPayload(r.Header) {
+		decodedLength, err := strconv.ParseInt(r.Header.Get("x-amz-decoded-content-length"), 10, 64)
+		if err != nil || decodedLength < 0 {
+			writeXMLErrorResponse(w, http.StatusLengthRequired, "MissingContentLength", "You must provide the Content-Length HTTP header.")
+			return nil, false
+		}
+		// Chunks are only signed when the request itself is, unsigned streaming payloads have no chunk signatures
+		var signer *requestAuth
+		if contentSHA256 := r.Header.Get("x-amz-content-sha256"); strings.HasPrefix(contentSHA256, "STREAMING-"+signV4Algorithm+"-PAYLOAD") {
+			signer = requestAuthentication(r)
+		}
+		chunked = newChunkedReader(body, r.Header.Get("x-amz-trailer"), signer)
+		body, size = chunked, decodedLength
+	}
+	payload := datastore.NewPayload(body, size)
+	if r.Header.Get("Content-MD5") != "" {
+		contentMD5, ok := parseContentMD5(w, r.Header)
+		if !ok {
+			return nil, false
+		}
+		payload.ContentMD5 = contentMD5
+	}
+	checksumAlgorithm, checksum, ok := parseChecksumHeaders(w, r.Header)
+	if !ok {
+		return nil, false
+	}
+	payload.ChecksumAlgorithm = checksumAlgorithm
+	payload.Checksum = checksum
+	if chunked != nil && chunked.trailer != "" {
+		trailerAlgorithm, ok := checksumHeaderAlgorithm(chunked.trailer)
+		if !ok || (checksumAlgorithm != "" && checksumAlgorithm != trailerAlgorithm) {
+			writeXMLErrorResponse(w, http.StatusBadRequest, "InvalidRequest", "The value specified in the x-amz-trailer header is not supported")
+			return nil, false
+		}
+		payload.ChecksumAlgorithm = trailerAlgorithm
+		payload.TrailingChecksum = chunked.trailingValue
+	}
+	contentSHA256 := r.Header.Get("x-amz-content-sha256")
+	// Unsigned and streaming payloads are not hashed as a whole
+	if contentSHA256 == "" || contentSHA256 == unsignedPayload || strings.HasPrefix(contentSHA256, "STREAMING-") {
+		return payload, true
+	}
+	sha256, err := hex.DecodeString(contentSHA256)
+	if err != nil || len(sha256) != 32 {
+		writeXMLErrorResponse(w, http.StatusBadRequest, "InvalidArgument", "x-amz-content-sha256 must be UNSIGNED-PAYLOAD, STREAMING-UNSIGNED-PAYLOAD-TRAILER, STREAMING-AWS4-HMAC-SHA256-PAYLOAD, STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER or a valid sha256 value.")
+		return nil, false
+	}
+	payload.ContentSHA256 = sha256
+	return payload, true
+}
+
+// parseContentMD5 decodes the Content-MD5 header.
+// Returns false if it is missing or invalid, in which case an error has been written to the response
+func parseContentMD5(w http.ResponseWriter, requestHeader http.Header) ([]byte, bool) {
+	contentMD5 := requestHeader.Get("Content-MD5")
+	if contentMD5 == "" {
+		writeXMLErrorResponse(w, http.StatusBadRequest, "InvalidRequest", "Missing required header for this request: Content-MD5")
+		return nil, false
+	}
+	decodedMD5, err := base64.StdEncoding.DecodeString(contentMD5)
+	if err != nil || len(decodedMD5) != md5.Size {
+		writeXMLErrorResponse(w, http.StatusBadRequest, "InvalidDigest", "The Content-MD5 you specified was invalid.")
+		return nil, false
+	}
+	return decodedMD5, true
+}
@@ -0,0 +1,346 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/anduintransaction/fakes3/datastore"
+	"github.com/palantir/stacktrace"
+	"goji.io/pat"
+)
+
+// maxPostFormFieldsSize bounds the size of the form fields preceding the file of a POST upload
+const maxPostFormFieldsSize = 20 * 1024
+
+// postPolicyExemptFields lists the form fields that do not need a policy condition
+var postPolicyExemptFields = map[string]bool{
+	"awsaccesskeyid":  true,
+	"file":            true,
+	"policy":          true,
+	"signature":       true,
+	"x-amz-signature": true,
+}
+
+type postResponse struct {
+	XMLName  xml.Name `xml:"PostResponse"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+// postPolicy is a decoded POST policy document
+type postPolicy struct {
+	Expiration string        `json:"expiration"`
+	Conditions []interface{} `json:"conditions"`
+}
+
+// isPostPolicyRequest tells if a request is a browser based upload, authenticated by its policy rather than by a request signature.
+// Bucket POST requests selecting a subresource, like ?delete, are never browser based uploads
+func isPostPolicyRequest(r *http.Request) bool {
+	if r.Method != http.MethodPost || hasSubresource(r.URL.Query()) || strings.Contains(strings.Trim(r.URL.Path, "/"), "/") {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "multipart/form-data"
+}
+
+// postPolicyUpload stores an object uploaded by a browser with a multipart/form-data form
+func (s *Server) postPolicyUpload(w http.ResponseWriter, r *http.Request) {
+	bucket := pat.Param(r, "bucket")
+	addCORSHeaders(w)
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+		writeXMLErrorResponse(w, http.StatusPreconditionFailed, "PreconditionFailed", "Bucket POST must be of the enclosure-type multipart/form-data")
+		return
+	}
+	fields, file, ok := readPostForm(w, multipart.NewReader(r.Body, params["boundary"]))
+	if !ok {
+		return
+	}
+	if fields["key"] == "" {
+		writeXMLErrorResponse(w, http.StatusBadRequest, "InvalidArgument", "Bucket POST must contain a field named 'key'.  If it is specified, please check the order of the fields.")
+		return
+	}
+	fields["key"] = strings.Replace(fields["key"], "${filename}", file.FileName(), -1)
+	fields["bucket"] = bucket
+	logrus.Debugf("Uploading object %q to bucket %q with a POST form", fields["key"], bucket)
+	if s.config.S3ApiServer.Auth.Enabled {
+		authErr := s.verifyPostSignature(fields)
+		if authErr != nil {
+			writeAuthErrorResponse(w, r, authErr)
+			return
+		}
+	}
+	minSize, maxSize := int64(0), int64(-1)
+	if fields["policy"] != "" {
+		var authErr *authError
+		minSize, maxSize, authErr = checkPostPolicy(fields, time.Now())
+		if authErr != nil {
+			writeAuthErrorResponse(w, r, authErr)
+			return
+		}
+	}
+	formHeader := http.Header{}
+	for name, value := range fields {
+		formHeader.Set(name, value)
+	}
+	metadata, ok := parseObjectMetadata(w, formHeader)
+	if !ok {
+		return
+	}
+	checksumAlgorithm, checksum, ok := parseChecksumHeaders(w, formHeader)
+	if !ok {
+		return
+	}
+	payload := datastore.NewPayload(&postFileReader{reader: file, minSize: minSize, maxSize: maxSize}, -1)
+	payload.ChecksumAlgorithm = checksumAlgorithm
+	payload.Checksum = checksum
+	objectInfo, err := s.objectStorage.PutObject(bucket, fields["key"], payload, metadata)
+	if err != nil {
+		storageErrorResponse(w, err)
+		return
+	}
+	s.postUploadResponse(w, r, fields, objectInfo)
+}
+
+// readPostForm reads the fields of a POST upload form up to its file, which is returned unread.
+// Field names are lower cased, fields following the file are ignored like s3 does.
+// Returns false if the form is invalid, in which case an error has been written to the response
+func readPostForm(w http.ResponseWriter, form *multipart.Reader) (map[string]string, *multipart.Part, bool) {
+	fields := map[string]string{}
+	remaining := int64(maxPostFormFieldsSize)
+	for {
+		part, err := form.NextPart()
+		if err == io.EOF {
+			writeXMLErrorResponse(w, http.StatusBadRequest, "InvalidArgument", "POST requires exactly one file upload per request.")
+			return nil, nil, false
+		}
+		if err != nil {
+			writeXMLErrorResponse(w, http.StatusBadRequest, "MalformedPOSTRequest", "The body of your POST request is not well-formed multipart/form-data.")
+			return nil, nil, false
+		}
+		name := strings.ToLower(part.FormName())
+		if name == "file" {
+			return fields, part, true
+		}
+		value, err := ioutil.ReadAll(io.LimitReader(part, remaining+1))
+		if err != nil {
+			writeXMLErrorResponse(w, http.StatusBadRequest, "MalformedPOSTRequest", "The body of your POST request is not well-formed multipart/form-data.")
+			return nil, nil, false
+		}
+		remaining -= int64(len(value))
+		if remaining < 0 {
+			writeXMLErrorResponse(w, http.StatusBadRequest, "MaxPostPreDataLengthExceeded", "Your POST request fields preceeding the upload file was too large.")
+			return nil, nil, false
+		}
+		fields[name] = string(value)
+	}
+}
+
+// verifyPostSignature checks the SigV4 or SigV2 signature of the policy of a POST upload
+func (s *Server) verifyPostSignature(fields map[string]string) *authError {
+	authConfig := s.config.S3ApiServer.Auth
+	if fields["policy"] == "" {
+		return newAuthError(http.StatusForbidden, "AccessDenied", "Access Denied")
+	}
+	var accessKeyID, expectedSignature, signature string
+	switch {
+	case fields["x-amz-signature"] != "":
+		if fields["x-amz-algorithm"] != signV4Algorithm {
+			return newAuthError(http.StatusBadRequest, "InvalidArgument", "Only AWS4-HMAC-SHA256 is supported as x-amz-algorithm")
+		}
+		sig := &signatureV4{}
+		if !parseCredential(sig, fields["x-amz-credential"]) {
+			return newAuthError(http.StatusBadRequest, "InvalidArgument", "Error parsing the X-Amz-Credential parameter; the Credential is mal-formed; expecting \"<YOUR-AKID>/YYYYMMDD/REGION/SERVICE/aws4_request\".")
+		}
+		if sig.region != authConfig.Region {
+			return newAuthError(http.StatusBadRequest, "InvalidArgument", fmt.Sprintf("Error parsing the X-Amz-Credential parameter; the region '%s' is wrong; expecting '%s'", sig.region, authConfig.Region))
+		}
+		_, secretAccessKey, ok := s.lookupAccessKey(sig.accessKeyID)
+		if !ok {
+			return newAuthError(http.StatusForbidden, "InvalidAccessKeyId", "The AWS Access Key Id you provided does not exist in our records.",
+				newXMLErrorDetail("AWSAccessKeyId", sig.accessKeyID))
+		}
+		accessKeyID, signature = sig.accessKeyID, fields["x-amz-signature"]
+		auth := &requestAuth{signingKey: signingKey(secretAccessKey, sig.date, sig.region, sig.service)}
+		expectedSignature = auth.sign(fields["policy"])
+	case fields["signature"] != "":
+		_, secretAccessKey, ok := s.lookupAccessKey(fields["awsaccesskeyid"])
+		if !ok {
+			return newAuthError(http.StatusForbidden, "InvalidAccessKeyId", "The AWS Access Key Id you provided does not exist in our records.",
+				newXMLErrorDetail("AWSAccessKeyId", fields["awsaccesskeyid"]))
+		}
+		accessKeyID, signature = fields["awsaccesskeyid"], fields["signature"]
+		expectedSignature = signV2(secretAccessKey, fields["policy"])
+	default:
+		return newAuthError(http.StatusForbidden, "AccessDenied", "Access Denied")
+	}
+	if !hmac.Equal([]byte(expectedSignature), []byte(signature)) {
+		return newAuthError(http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided. Check your key and signing method.",
+			newXMLErrorDetail("AWSAccessKeyId", accessKeyID),
+			newXMLErrorDetail("StringToSign", fields["policy"]),
+			newXMLErrorDetail("SignatureProvided", signature))
+	}
+	return nil
+}
+
+// checkPostPolicy evaluates the policy of a POST upload against its fields and returns the allowed file size range, -1 meaning no maximum
+func checkPostPolicy(fields map[string]string, now time.Time) (int64, int64, *authError) {
+	minSize, maxSize := int64(0), int64(-1)
+	content, err := base64.StdEncoding.DecodeString(fields["policy"])
+	if err != nil {
+		return 0, 0, newAuthError(http.StatusBadRequest, "InvalidPolicyDocument", "Invalid Policy: Invalid 'Policy' base64 encoding.")
+	}
+	policy := &postPolicy{}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	if decoder.Decode(policy) != nil {
+		return 0, 0, newAuthError(http.StatusBadRequest, "InvalidPolicyDocument", "Invalid Policy: Invalid JSON.")
+	}
+	if policy.Expiration == "" {
+		return 0, 0, newAuthError(http.StatusBadRequest, "InvalidPolicyDocument", "Invalid Policy: Policy missing expiration.")
+	}
+	expiration, err := time.Parse(time.RFC3339, policy.Expiration)
+	if err != nil {
+		return 0, 0, newAuthError(http.StatusBadRequest, "InvalidPolicyDocument", fmt.Sprintf("Invalid Policy: Invalid 'expiration' value: '%s'", policy.Expiration))
+	}
+	if now.After(expiration) {
+		return 0, 0, newAuthError(http.StatusForbidden, "AccessDenied", "Invalid according to Policy: Policy expired.")
+	}
+	covered := map[string]bool{}
+	for _, condition := range policy.Conditions {
+		switch condition := condition.(type) {
+		case map[string]interface{}:
+			for name, expected := range condition {
+				name = strings.ToLower(name)
+				covered[name] = true
+				if fields[name] != fmt.Sprint(expected) {
+					return 0, 0, policyConditionFailed(condition)
+				}
+			}
+		case []interface{}:
+			if len(condition) != 3 {
+				return 0, 0, newAuthError(http.StatusBadRequest, "InvalidPolicyDocument", "Invalid Policy: Invalid Condition: wrong number of arguments.")
+			}
+			operator := strings.ToLower(fmt.Sprint(condition[0]))
+			if operator == "content-length-range" {
+				min, minErr := strconv.ParseInt(fmt.Sprint(condition[1]), 10, 64)
+				max, maxErr := strconv.ParseInt(fmt.Sprint(condition[2]), 10, 64)
+				if minErr != nil || maxErr != nil {
+					return 0, 0, newAuthError(http.StatusBadRequest, "InvalidPolicyDocument", "Invalid Policy: Invalid content-length-range.")
+				}
+				minSize, maxSize = min, max
+				continue
+			}
+			name := strings.ToLower(strings.TrimPrefix(fmt.Sprint(condition[1]), "$"))
+			expected := fmt.Sprint(condition[2])
+			covered[name] = true
+			switch operator {
+			case "eq":
+				if fields[name] != expected {
+					return 0, 0, policyConditionFailed(condition)
+				}
+			case "starts-with":
+				if !strings.HasPrefix(fields[name], expected) {
+					return 0, 0, policyConditionFailed(condition)
+				}
+			default:
+				return 0, 0, newAuthError(http.StatusBadRequest, "InvalidPolicyDocument", fmt.Sprintf("Invalid Policy: Invalid Condition: unknown operation '%s'.", operator))
+			}
+		default:
+			return 0, 0, newAuthError(http.StatusBadRequest, "InvalidPolicyDocument", "Invalid Policy: Invalid Condition.")
+		}
+	}
+	extraFields := []string{}
+	for name := range fields {
+		if !covered[name] && name != "bucket" && !postPolicyExemptFields[name] && !strings.HasPrefix(name, "x-ignore-") {
+			extraFields = append(extraFields, name)
+		}
+	}
+	if len(extraFields) > 0 {
+		return 0, 0, newAuthError(http.StatusForbidden, "AccessDenied", "Invalid according to Policy: Extra input fields: "+strings.Join(extraFields, ", "))
+	}
+	return minSize, maxSize, nil
+}
+
+func policyConditionFailed(condition interface{}) *authError {
+	encoded, _ := json.Marshal(condition)
+	return newAuthError(http.StatusForbidden, "AccessDenied", fmt.Sprintf("Invalid according to Policy: Policy Condition failed: %s", encoded))
+}
+
+// postUploadResponse answers a successful POST upload with a redirection, or with the status requested by the form
+func (s *Server) postUploadResponse(w http.ResponseWriter, r *http.Request, fields map[string]string, objectInfo *datastore.ObjectInfo) {
+	bucket, objectKey := fields["bucket"], fields["key"]
+	etag := quoteETag(objectInfo.Metadata.ETag)
+	location := generateFullObjectPath(s.config.S3ApiServer.AdvertisedAddr, r, bucket, objectKey)
+	responseHeader := w.Header()
+	responseHeader.Set("ETag", etag)
+	responseHeader.Set("Location", location)
+	redirect := fields["success_action_redirect"]
+	if redirect == "" {
+		redirect = fields["redirect"]
+	}
+	if redirectURL, err := url.Parse(redirect); redirect != "" && err == nil {
+		query := redirectURL.Query()
+		query.Set("bucket", bucket)
+		query.Set("key", objectKey)
+		query.Set("etag", etag)
+		redirectURL.RawQuery = query.Encode()
+		responseHeader.Set("Location", redirectURL.String())
+		writeCommonHeaders(responseHeader)
+		w.WriteHeader(http.StatusSeeOther)
+		return
+	}
+	switch fields["success_action_status"] {
+	case "200":
+		writeEmptySuccessResponse(w)
+	case "201":
+		err := writeXMLResponseWithStatus(w, http.StatusCreated, &postResponse{
+			Location: location,
+			Bucket:   bucket,
+			Key:      objectKey,
+			ETag:     etag,
+		})
+		if err != nil {
+			logrus.Error(err)
+		}
+	default:
+		writeCommonHeaders(responseHeader)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// postFileReader reads the file of a POST upload, failing if its size is out of the range allowed by the policy
+type postFileReader struct {
+	reader  io.Reader
+	minSize int64
+	maxSize int64 // negative for no maximum
+	read    int64
+}
+
+func (p *postFileReader) Read(b []byte) (int, error) {
+	n, err := p.reader.Read(b)
+	p.read += int64(n)
+	if p.maxSize >= 0 && p.read > p.maxSize {
+		return n, stacktrace.NewErrorWithCode(datastore.ErrCodeEntityTooLarge, "POST upload is larger than the %d bytes allowed by its policy", p.maxSize)
+	}
+	if err == io.EOF && p.read < p.minSize {
+		return n, stacktrace.NewErrorWithCode(datastore.ErrCodeEntityTooSmall, "POST upload is smaller than the %d bytes required by its policy", p.minSize)
+	}
+	return n, err
+}
@@ -0,0 +1,235 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPostPolicyBypassExcludesSubresources(t *testing.T) {
+	s, cleanup := newTestServer(t, true)
+	defer cleanup()
+	putTestObject(t, s, "kept", "content")
+	body := `<Delete><Object><Key>kept</Key></Object></Delete>`
+	r := httptest.NewRequest(http.MethodPost, "/"+testBucket+"?delete", strings.NewReader(body))
+	r.Header.Set("Content-Type", "multipart/form-data; boundary=xyz")
+	w := serveTestRequest(s, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("Unsigned multipart ?delete returned %d, expecting %d: %s", w.Code, http.StatusForbidden, w.Body.String())
+	}
+	if _, err := s.objectStorage.GetObjectInfo(testBucket, "kept"); err != nil {
+		t.Fatalf("Object was deleted by an unsigned request: %s", err)
+	}
+}
+
+func TestIsPostPolicyRequest(t *testing.T) {
+	tests := []struct {
+		method      string
+		target      string
+		contentType string
+		expected    bool
+	}{
+		{http.MethodPost, "/bucket", "multipart/form-data; boundary=xyz", true},
+		{http.MethodPost, "/bucket/", "multipart/form-data; boundary=xyz", true},
+		{http.MethodPost, "/bucket?delete", "multipart/form-data; boundary=xyz", false},
+		{http.MethodPost, "/bucket?uploads", "multipart/form-data; boundary=xyz", false},
+		{http.MethodPost, "/bucket/key", "multipart/form-data; boundary=xyz", false},
+		{http.MethodPost, "/bucket", "application/xml", false},
+		{http.MethodPut, "/bucket", "multipart/form-data; boundary=xyz", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.target, nil)
+		r.Header.Set("Content-Type", test.contentType)
+		if actual := isPostPolicyRequest(r); actual != test.expected {
+			t.Errorf("isPostPolicyRequest(%s %s, %s) = %v, expecting %v", test.method, test.target, test.contentType, actual, test.expected)
+		}
+	}
+}
+
+// testPolicyTime is the time POST policies are checked at, policies of testPostPolicy expire a day later
+var testPolicyTime = time.Date(2015, 12, 29, 12, 0, 0, 0, time.UTC)
+
+func testPostPolicy(conditions string) string {
+	return base64.StdEncoding.EncodeToString([]byte(`{"expiration":"2015-12-30T12:00:00.000Z","conditions":[` + conditions + `]}`))
+}
+
+func TestCheckPostPolicy(t *testing.T) {
+	fields := map[string]string{
+		"bucket":         testBucket,
+		"key":            "uploads/photo.jpg",
+		"content-type":   "image/jpeg",
+		"x-amz-meta-tag": "value",
+		"x-ignore-field": "ignored",
+	}
+	const coveringConditions = `{"bucket":"test-bucket"},["starts-with","$key","uploads/"],{"Content-Type":"image/jpeg"},["eq","$x-amz-meta-tag","value"]`
+	tests := []struct {
+		name           string
+		policy         string
+		expectedStatus int // 0 if the policy is satisfied
+		expectedCode   string
+		expectedMin    int64
+		expectedMax    int64
+	}{
+		{"Satisfied", testPostPolicy(coveringConditions), 0, "", 0, -1},
+		{"ContentLengthRange", testPostPolicy(coveringConditions + `,["content-length-range",1,1048576]`), 0, "", 1, 1048576},
+		{"ContentLengthRangeStrings", testPostPolicy(coveringConditions + `,["content-length-range","10","20"]`), 0, "", 10, 20},
+		{"StartsWithAnything", testPostPolicy(`{"bucket":"test-bucket"},["starts-with","$key",""],["starts-with","$content-type",""],["starts-with","$x-amz-meta-tag",""]`), 0, "", 0, -1},
+		{"EqOperatorCase", testPostPolicy(`{"bucket":"test-bucket"},["EQ","$key","uploads/photo.jpg"],["Starts-With","$Content-Type","image/"],["eq","$x-amz-meta-tag","value"]`), 0, "", 0, -1},
+		{"Expired", base64.StdEncoding.EncodeToString([]byte(`{"expiration":"2015-12-29T11:59:59Z","conditions":[` + coveringConditions + `]}`)), http.StatusForbidden, "AccessDenied", 0, 0},
+		{"NoExpiration", base64.StdEncoding.EncodeToString([]byte(`{"conditions":[` + coveringConditions + `]}`)), http.StatusBadRequest, "InvalidPolicyDocument", 0, 0},
+		{"InvalidExpiration", base64.StdEncoding.EncodeToString([]byte(`{"expiration":"tomorrow","conditions":[]}`)), http.StatusBadRequest, "InvalidPolicyDocument", 0, 0},
+		{"InvalidBase64", "not base64!", http.StatusBadRequest, "InvalidPolicyDocument", 0, 0},
+		{"InvalidJSON", base64.StdEncoding.EncodeToString([]byte(`{"expiration":`)), http.StatusBadRequest, "InvalidPolicyDocument", 0, 0},
+		{"ExactMatchFailed", testPostPolicy(`{"bucket":"test-bucket"},["starts-with","$key","uploads/"],{"content-type":"image/png"},["eq","$x-amz-meta-tag","value"]`), http.StatusForbidden, "AccessDenied", 0, 0},
+		{"EqFailed", testPostPolicy(`{"bucket":"test-bucket"},["starts-with","$key","uploads/"],{"content-type":"image/jpeg"},["eq","$x-amz-meta-tag","other"]`), http.StatusForbidden, "AccessDenied", 0, 0},
+		{"StartsWithFailed", testPostPolicy(`{"bucket":"test-bucket"},["starts-with","$key","private/"],{"content-type":"image/jpeg"},["eq","$x-amz-meta-tag","value"]`), http.StatusForbidden, "AccessDenied", 0, 0},
+		{"OtherBucket", testPostPolicy(`{"bucket":"other-bucket"},["starts-with","$key","uploads/"],{"content-type":"image/jpeg"},["eq","$x-amz-meta-tag","value"]`), http.StatusForbidden, "AccessDenied", 0, 0},
+		{"ExtraField", testPostPolicy(`{"bucket":"test-bucket"},["starts-with","$key","uploads/"],{"content-type":"image/jpeg"}`), http.StatusForbidden, "AccessDenied", 0, 0},
+		{"UnknownOperator", testPostPolicy(coveringConditions + `,["gt","$key","a"]`), http.StatusBadRequest, "InvalidPolicyDocument", 0, 0},
+		{"WrongArgumentCount", testPostPolicy(coveringConditions + `,["eq","$key"]`), http.StatusBadRequest, "InvalidPolicyDocument", 0, 0},
+		{"InvalidContentLengthRange", testPostPolicy(coveringConditions + `,["content-length-range","small",10]`), http.StatusBadRequest, "InvalidPolicyDocument", 0, 0},
+		{"InvalidCondition", testPostPolicy(coveringConditions + `,"key"`), http.StatusBadRequest, "InvalidPolicyDocument", 0, 0},
+	}
+	for _, test := range tests {
+		fields["policy"] = test.policy
+		minSize, maxSize, authErr := checkPostPolicy(fields, testPolicyTime)
+		if test.expectedStatus == 0 {
+			if authErr != nil {
+				t.Errorf("%s: rejected with %s: %s", test.name, authErr.code, authErr.message)
+			} else if minSize != test.expectedMin || maxSize != test.expectedMax {
+				t.Errorf("%s: allowed sizes %d to %d, expecting %d to %d", test.name, minSize, maxSize, test.expectedMin, test.expectedMax)
+			}
+			continue
+		}
+		if authErr == nil || authErr.statusCode != test.expectedStatus || authErr.code != test.expectedCode {
+			t.Errorf("%s: returned %+v, expecting %d %s", test.name, authErr, test.expectedStatus, test.expectedCode)
+		}
+	}
+}
+
+// signTestPolicyV4 signs a POST policy like browsers forms do, independently of the server signing code
+func signTestPolicyV4(secretAccessKey, date, region, policy string) string {
+	key := []byte("AWS4" + secretAccessKey)
+	for _, data := range []string{date, region, "s3", "aws4_request", policy} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(data))
+		key = mac.Sum(nil)
+	}
+	return hex.EncodeToString(key)
+}
+
+func signTestPolicyV2(secretAccessKey, policy string) string {
+	mac := hmac.New(sha1.New, []byte(secretAccessKey))
+	mac.Write([]byte(policy))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyPostSignature(t *testing.T) {
+	s, cleanup := newTestServer(t, true)
+	defer cleanup()
+	policy := testPostPolicy(`{"bucket":"test-bucket"}`)
+	credential := testAccessKeyID + "/20151229/" + testRegion + "/s3/aws4_request"
+	v4Signature := signTestPolicyV4(testSecretAccessKey, "20151229", testRegion, policy)
+	v2Signature := signTestPolicyV2(testSecretAccessKey, policy)
+	tests := []struct {
+		name           string
+		fields         map[string]string
+		expectedStatus int // 0 if the signature is valid
+		expectedCode   string
+	}{
+		{"V4", map[string]string{"policy": policy, "x-amz-algorithm": signV4Algorithm, "x-amz-credential": credential, "x-amz-signature": v4Signature}, 0, ""},
+		{"V4WrongSignature", map[string]string{"policy": policy, "x-amz-algorithm": signV4Algorithm, "x-amz-credential": credential, "x-amz-signature": signTestPolicyV4("wrong", "20151229", testRegion, policy)}, http.StatusForbidden, "SignatureDoesNotMatch"},
+		{"V4TamperedPolicy", map[string]string{"policy": testPostPolicy(`{"bucket":"other-bucket"}`), "x-amz-algorithm": signV4Algorithm, "x-amz-credential": credential, "x-amz-signature": v4Signature}, http.StatusForbidden, "SignatureDoesNotMatch"},
+		{"V4UnknownAccessKey", map[string]string{"policy": policy, "x-amz-algorithm": signV4Algorithm, "x-amz-credential": "AKIAUNKNOWN/20151229/" + testRegion + "/s3/aws4_request", "x-amz-signature": v4Signature}, http.StatusForbidden, "InvalidAccessKeyId"},
+		{"V4WrongRegion", map[string]string{"policy": policy, "x-amz-algorithm": signV4Algorithm, "x-amz-credential": testAccessKeyID + "/20151229/eu-west-1/s3/aws4_request", "x-amz-signature": v4Signature}, http.StatusBadRequest, "InvalidArgument"},
+		{"V4MalformedCredential", map[string]string{"policy": policy, "x-amz-algorithm": signV4Algorithm, "x-amz-credential": testAccessKeyID, "x-amz-signature": v4Signature}, http.StatusBadRequest, "InvalidArgument"},
+		{"V4WrongAlgorithm", map[string]string{"policy": policy, "x-amz-algorithm": "AWS4-HMAC-SHA1", "x-amz-credential": credential, "x-amz-signature": v4Signature}, http.StatusBadRequest, "InvalidArgument"},
+		{"V2", map[string]string{"policy": policy, "awsaccesskeyid": testAccessKeyID, "signature": v2Signature}, 0, ""},
+		{"V2WrongSignature", map[string]string{"policy": policy, "awsaccesskeyid": testAccessKeyID, "signature": signTestPolicyV2("wrong", policy)}, http.StatusForbidden, "SignatureDoesNotMatch"},
+		{"V2UnknownAccessKey", map[string]string{"policy": policy, "awsaccesskeyid": "AKIAUNKNOWN", "signature": v2Signature}, http.StatusForbidden, "InvalidAccessKeyId"},
+		{"NoSignature", map[string]string{"policy": policy}, http.StatusForbidden, "AccessDenied"},
+		{"NoPolicy", map[string]string{"awsaccesskeyid": testAccessKeyID, "signature": v2Signature}, http.StatusForbidden, "AccessDenied"},
+	}
+	for _, test := range tests {
+		authErr := s.verifyPostSignature(test.fields)
+		if test.expectedStatus == 0 {
+			if authErr != nil {
+				t.Errorf("%s: rejected with %s: %s", test.name, authErr.code, authErr.message)
+			}
+			continue
+		}
+		if authErr == nil || authErr.statusCode != test.expectedStatus || authErr.code != test.expectedCode {
+			t.Errorf("%s: returned %+v, expecting %d %s", test.name, authErr, test.expectedStatus, test.expectedCode)
+		}
+	}
+}
+
+// postTestForm posts a browser upload form, fields are written in order before the file
+func postTestForm(t *testing.T, s *Server, fields [][2]string, content string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for _, field := range fields {
+		err := form.WriteField(field[0], field[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	file, err := form.CreateFormFile("file", "photo.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte(content))
+	form.Close()
+	r := httptest.NewRequest(http.MethodPost, "/"+testBucket, &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	return serveTestRequest(s, r)
+}
+
+func TestPostPolicyUpload(t *testing.T) {
+	s, cleanup := newTestServer(t, true)
+	defer cleanup()
+	date := time.Now().UTC().Format("20060102")
+	credential := testAccessKeyID + "/" + date + "/" + testRegion + "/s3/aws4_request"
+	expiration := time.Now().UTC().Add(time.Hour).Format(time.RFC3339)
+	tests := []struct {
+		name             string
+		lengthRange      string
+		content          string
+		expectedStatus   int
+		expectedResponse string
+	}{
+		{"InRange", "1,10", "content", http.StatusNoContent, ""},
+		{"TooLarge", "1,3", "content", http.StatusBadRequest, "<Code>EntityTooLarge</Code>"},
+		{"TooSmall", "10,20", "content", http.StatusBadRequest, "<Code>EntityTooSmall</Code>"},
+	}
+	for _, test := range tests {
+		objectKey := "uploads/" + test.name
+		policy := base64.StdEncoding.EncodeToString([]byte(`{"expiration":"` + expiration + `","conditions":[` +
+			`{"bucket":"test-bucket"},["starts-with","$key","uploads/"],["content-length-range",` + test.lengthRange + `],` +
+			`{"x-amz-algorithm":"AWS4-HMAC-SHA256"},{"x-amz-credential":"` + credential + `"},["starts-with","$x-amz-date",""]]}`))
+		w := postTestForm(t, s, [][2]string{
+			{"key", objectKey},
+			{"x-amz-algorithm", signV4Algorithm},
+			{"x-amz-credential", credential},
+			{"x-amz-date", date + "T000000Z"},
+			{"policy", policy},
+			{"x-amz-signature", signTestPolicyV4(testSecretAccessKey, date, testRegion, policy)},
+		}, test.content)
+		if w.Code != test.expectedStatus || !strings.Contains(w.Body.String(), test.expectedResponse) {
+			t.Errorf("%s: returned %d: %s", test.name, w.Code, w.Body.String())
+		}
+		_, err := s.objectStorage.GetObjectInfo(testBucket, objectKey)
+		if stored := err == nil; stored != (test.expectedStatus == http.StatusNoContent) {
+			t.Errorf("%s: object stored is %v", test.name, stored)
+		}
+	}
+}
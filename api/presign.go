@@ -0,0 +1,116 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anduintransaction/fakes3/config"
+	"github.com/anduintransaction/fakes3/datastore"
+	"github.com/palantir/stacktrace"
+)
+
+// PresignRequest describes a presigned url to generate
+type PresignRequest struct {
+	Method           string
+	Bucket           string
+	Key              string
+	AccessKeyID      string // empty to sign with the first access key of the config file
+	Expires          time.Duration
+	SignatureVersion int // 4, or 2 for legacy clients
+}
+
+// PresignURL returns a url allowing anyone to send a request for an object until it expires,
+// signed with the configured credentials and pointing to the advertised address of the server
+func PresignURL(s3Config *config.S3ApiServerConfig, credentialStorage *datastore.CredentialStorage, request *PresignRequest, now time.Time) (string, error) {
+	authConfig := s3Config.Auth
+	accessKeyID := request.AccessKeyID
+	if accessKeyID == "" {
+		if len(authConfig.AccessKeys) == 0 {
+			return "", stacktrace.NewError("No access key is configured")
+		}
+		accessKeyID = authConfig.AccessKeys[0].AccessKeyID
+	}
+	_, secretAccessKey, ok := lookupAccessKey(authConfig, credentialStorage, accessKeyID)
+	if !ok {
+		return "", stacktrace.NewError("Access key %q does not exist", accessKeyID)
+	}
+	if request.Expires < time.Second {
+		return "", stacktrace.NewError("Presigned urls must be valid for at least one second")
+	}
+	u, err := url.Parse(presignEndpoint(s3Config) + "/" + uriEncode(request.Bucket) + "/" + encodeKeyPath(request.Key))
+	if err != nil {
+		return "", stacktrace.Propagate(err, "Invalid advertised address %q", s3Config.AdvertisedAddr)
+	}
+	r := &http.Request{
+		Method: strings.ToUpper(request.Method),
+		URL:    u,
+		Host:   u.Host,
+		Header: http.Header{},
+	}
+	switch request.SignatureVersion {
+	case 2:
+		expires := strconv.FormatInt(now.Add(request.Expires).Unix(), 10)
+		signature := signV2(secretAccessKey, stringToSignV2(r, expires))
+		u.RawQuery = url.Values{
+			"AWSAccessKeyId": {accessKeyID},
+			"Expires":        {expires},
+			"Signature":      {signature},
+		}.Encode()
+	case 4:
+		if request.Expires > maxPresignedExpiry {
+			return "", stacktrace.NewError("SigV4 presigned urls cannot be valid for more than %s", maxPresignedExpiry)
+		}
+		amzDate := now.UTC().Format(amzDateFormat)
+		sig := &signatureV4{
+			accessKeyID:   accessKeyID,
+			date:          amzDate[:8],
+			region:        authConfig.Region,
+			service:       "s3",
+			terminator:    "aws4_request",
+			signedHeaders: []string{"host"},
+			amzDate:       amzDate,
+			payloadHash:   unsignedPayload,
+			presigned:     true,
+			expires:       request.Expires,
+		}
+		u.RawQuery = url.Values{
+			"X-Amz-Algorithm":     {signV4Algorithm},
+			"X-Amz-Credential":    {accessKeyID + "/" + sig.scope()},
+			"X-Amz-Date":          {amzDate},
+			"X-Amz-Expires":       {strconv.FormatInt(int64(request.Expires/time.Second), 10)},
+			"X-Amz-SignedHeaders": {"host"},
+		}.Encode()
+		auth := &requestAuth{
+			signingKey: signingKey(secretAccessKey, sig.date, sig.region, sig.service),
+		}
+		stringToSign := strings.Join([]string{signV4Algorithm, amzDate, sig.scope(), sha256Hex(canonicalRequestV4(r, sig))}, "\n")
+		u.RawQuery += "&X-Amz-Signature=" + auth.sign(stringToSign)
+	default:
+		return "", stacktrace.NewError("Unsupported signature version %d", request.SignatureVersion)
+	}
+	return u.String(), nil
+}
+
+// presignEndpoint returns the advertised address of the server, or its local address if none is configured
+func presignEndpoint(s3Config *config.S3ApiServerConfig) string {
+	if s3Config.AdvertisedAddr != "" {
+		return strings.TrimSuffix(s3Config.AdvertisedAddr, "/")
+	}
+	addr := s3Config.HTTP.Addr
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
+	}
+	return "http://" + addr
+}
+
+// encodeKeyPath escapes each segment of an object key the way SigV4 canonical uris are escaped
+func encodeKeyPath(objectKey string) string {
+	segments := strings.Split(objectKey, "/")
+	for i, segment := range segments {
+		segments[i] = uriEncode(segment)
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,65 @@
+// Copyright © 2017 Anduin Transactions Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/anduintransaction/fakes3/config"
+	"github.com/anduintransaction/fakes3/datastore"
+	"github.com/spf13/cobra"
+)
+
+// migrateCmd represents the migrate command
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Migrate a data folder to the current storage layout",
+	Long:  "Migrate a data folder written by an older version to the current storage layout. The server must be stopped while migrating",
+	Run: func(cmd *cobra.Command, args []string) {
+		bindCommandFlag(cmd, "s3ApiServer.dataFolder", "s3DataFolder")
+		config, err := config.ReadConfig()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot read config file, the error is: %s\n", err)
+			os.Exit(1)
+		}
+		setupLogger(config)
+		result, err := datastore.MigrateLayout(config.S3ApiServer.DataFolder)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot migrate data folder, the error is: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Migrated %d objects in %s\n", result.Migrated, config.S3ApiServer.DataFolder)
+		if len(result.SkippedBuckets) > 0 {
+			fmt.Printf("Skipped buckets with invalid names, their objects are left as is: %s\n", strings.Join(result.SkippedBuckets, ", "))
+		}
+		if len(result.SkippedObjects) > 0 {
+			fmt.Printf("Skipped objects with invalid keys, moved to the unmigrated folder: %s\n", strings.Join(result.SkippedObjects, ", "))
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(migrateCmd)
+
+	migrateCmd.Flags().StringP("s3DataFolder", "d", "/data/fakes3", "Data folder for s3")
+}
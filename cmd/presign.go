@@ -0,0 +1,88 @@
+// Copyright © 2017 Anduin Transactions Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/anduintransaction/fakes3/api"
+	"github.com/anduintransaction/fakes3/config"
+	"github.com/anduintransaction/fakes3/datastore"
+	"github.com/spf13/cobra"
+)
+
+// presignCmd represents the presign command
+var presignCmd = &cobra.Command{
+	Use:   "presign <bucket>/<key>",
+	Short: "Generate a presigned url for an object",
+	Long:  "Generate a presigned url allowing anyone to send a request for an object until it expires, signed with the configured credentials",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			fmt.Fprintln(os.Stderr, "Expecting a single <bucket>/<key> argument")
+			os.Exit(1)
+		}
+		parts := strings.SplitN(strings.TrimPrefix(args[0], "s3://"), "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			fmt.Fprintf(os.Stderr, "Invalid object %q, expecting <bucket>/<key>\n", args[0])
+			os.Exit(1)
+		}
+		bindCommandFlag(cmd, "s3ApiServer.advertisedAddr", "s3AdvertisedAddr")
+		bindCommandFlag(cmd, "s3ApiServer.dataFolder", "s3DataFolder")
+		config, err := config.ReadConfig()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot read config file, the error is: %s\n", err)
+			os.Exit(1)
+		}
+		flags := cmd.Flags()
+		method, _ := flags.GetString("method")
+		accessKeyID, _ := flags.GetString("accessKeyID")
+		expires, _ := flags.GetDuration("expires")
+		signatureVersion, _ := flags.GetInt("signatureVersion")
+		credentialStorage := datastore.NewCredentialStorage(config.S3ApiServer.DataFolder)
+		presignedURL, err := api.PresignURL(config.S3ApiServer, credentialStorage, &api.PresignRequest{
+			Method:           method,
+			Bucket:           parts[0],
+			Key:              parts[1],
+			AccessKeyID:      accessKeyID,
+			Expires:          expires,
+			SignatureVersion: signatureVersion,
+		}, time.Now())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot presign url, the error is: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(presignedURL)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(presignCmd)
+
+	presignCmd.Flags().StringP("method", "X", "GET", "HTTP method the url can be used with")
+	presignCmd.Flags().DurationP("expires", "e", time.Hour, "How long the url is valid")
+	presignCmd.Flags().String("accessKeyID", "", "Access key to sign the url with, the first one of the config file if empty")
+	presignCmd.Flags().Int("signatureVersion", 4, "Signature version, 4 or 2 for legacy clients")
+	presignCmd.Flags().StringP("s3DataFolder", "d", "/data/fakes3", "Data folder for s3, to sign with the access keys of its users")
+	presignCmd.Flags().StringP("s3AdvertisedAddr", "a", "", "Address of the server in the url, defaults to the configured advertised address")
+}
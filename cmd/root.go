@@ -52,6 +52,12 @@ func init() {
 	RootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", fmt.Sprintf("config file (default is $HOME/%s.yaml)", common.AppName))
 }
 
+// bindCommandFlag binds a config key to a flag of the command being run. Commands sharing a config key with the
+// server command must call it when they run rather than in init, only the last binding of a key is kept
+func bindCommandFlag(cmd *cobra.Command, key, flagName string) {
+	viper.BindPFlag(key, cmd.Flag(flagName))
+}
+
 // initConfig reads in config file and ENV variables if set.
 func initConfig() {
 	if cfgFile != "" { // enable ability to specify config file via flag
@@ -82,9 +82,14 @@ func setupLogger(config *config.Config) {
 }
 
 func runServer(config *config.Config) {
+	s3ApiServer, err := api.NewServer(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot create s3 api server, the error is: %s\n", err)
+		os.Exit(1)
+	}
 	apiServer := server.NewHTTPServer(config.S3ApiServer.HTTP)
-	apiServer.Start(api.NewServer(config).Mux)
-	err := apiServer.Wait()
+	apiServer.Start(s3ApiServer.Mux)
+	err = apiServer.Wait()
 	if err != nil {
 		logrus.Error(err)
 	}
@@ -96,7 +101,15 @@ func init() {
 	serverCmd.Flags().StringP("s3ApiAddr", "b", ":8000", "Listening address for s3 api server")
 	serverCmd.Flags().StringP("s3DataFolder", "d", "/data/fakes3", "Data folder for s3")
 	serverCmd.Flags().StringP("s3AdvertisedAddr", "a", "", "Advertised address, for prepending to some response. If empty then this value will be calculated from Host Header")
+	serverCmd.Flags().Bool("s3AutoCreateBuckets", false, "Create missing buckets on first write instead of returning NoSuchBucket")
+	serverCmd.Flags().StringSlice("s3PreCreateBuckets", []string{}, "Buckets to create when the server starts")
+	serverCmd.Flags().Bool("s3AuthEnabled", false, "Verify request signatures against the configured access keys instead of accepting anonymous requests")
+	serverCmd.Flags().String("s3AuthRegion", "us-east-1", "Region requests must be signed for")
 	viper.BindPFlag("s3ApiServer.http.addr", serverCmd.Flags().Lookup("s3ApiAddr"))
 	viper.BindPFlag("s3ApiServer.dataFolder", serverCmd.Flags().Lookup("s3DataFolder"))
 	viper.BindPFlag("s3ApiServer.advertisedAddr", serverCmd.Flags().Lookup("s3AdvertisedAddr"))
+	viper.BindPFlag("s3ApiServer.autoCreateBuckets", serverCmd.Flags().Lookup("s3AutoCreateBuckets"))
+	viper.BindPFlag("s3ApiServer.preCreateBuckets", serverCmd.Flags().Lookup("s3PreCreateBuckets"))
+	viper.BindPFlag("s3ApiServer.auth.enabled", serverCmd.Flags().Lookup("s3AuthEnabled"))
+	viper.BindPFlag("s3ApiServer.auth.region", serverCmd.Flags().Lookup("s3AuthRegion"))
 }
@@ -0,0 +1,142 @@
+// Copyright © 2017 Anduin Transactions Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/anduintransaction/fakes3/config"
+	"github.com/anduintransaction/fakes3/datastore"
+	"github.com/spf13/cobra"
+)
+
+// userCmd represents the user command
+var userCmd = &cobra.Command{
+	Use:   "user",
+	Short: "Manage the users requests can be authenticated as",
+	Long:  "Manage the users of the credential store of the data folder, and their access keys. A running server picks up changes without restarting",
+}
+
+var userCreateCmd = &cobra.Command{
+	Use:   "create <name>",
+	Short: "Create a user with a new access key",
+	Long:  "Create a user with a new access key, in the given account which is created if it does not exist",
+	Run: func(cmd *cobra.Command, args []string) {
+		userName := userNameArg(args)
+		accountName, _ := cmd.Flags().GetString("account")
+		identity, accessKey, err := openCredentialStorage(cmd).CreateUser(userName, accountName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot create user, the error is: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Created user %s in account %s (%s)\n", identity.User.Name, identity.Account.Name, identity.Account.ID)
+		printAccessKey(accessKey)
+	},
+}
+
+var userListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List users and their access keys",
+	Long:  "List users and their access keys",
+	Run: func(cmd *cobra.Command, args []string) {
+		identities, err := openCredentialStorage(cmd).ListUsers()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot list users, the error is: %s\n", err)
+			os.Exit(1)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "USER\tACCOUNT\tACCOUNT ID\tACCESS KEY ID\tCREATED")
+		for _, identity := range identities {
+			accountID := ""
+			if identity.Account != nil {
+				accountID = identity.Account.ID
+			}
+			for _, accessKey := range identity.User.AccessKeys {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", identity.User.Name, identity.User.Account, accountID, accessKey.AccessKeyID, accessKey.Created.Format("2006-01-02 15:04:05"))
+			}
+		}
+		tw.Flush()
+	},
+}
+
+var userDeleteCmd = &cobra.Command{
+	Use:   "delete <name>",
+	Short: "Delete a user and its access keys",
+	Long:  "Delete a user and its access keys. Its account keeps owning what the user created",
+	Run: func(cmd *cobra.Command, args []string) {
+		userName := userNameArg(args)
+		err := openCredentialStorage(cmd).DeleteUser(userName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot delete user, the error is: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Deleted user %s\n", userName)
+	},
+}
+
+var userRotateKeyCmd = &cobra.Command{
+	Use:   "rotate-key <name>",
+	Short: "Replace the access key of a user",
+	Long:  "Replace the access keys of a user with a new one, requests signed with the previous ones are rejected",
+	Run: func(cmd *cobra.Command, args []string) {
+		userName := userNameArg(args)
+		accessKey, err := openCredentialStorage(cmd).RotateAccessKey(userName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot rotate access key, the error is: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Rotated access key of user %s\n", userName)
+		printAccessKey(accessKey)
+	},
+}
+
+func userNameArg(args []string) string {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Expecting a single user name argument")
+		os.Exit(1)
+	}
+	return args[0]
+}
+
+func openCredentialStorage(cmd *cobra.Command) *datastore.CredentialStorage {
+	bindCommandFlag(cmd, "s3ApiServer.dataFolder", "s3DataFolder")
+	config, err := config.ReadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot read config file, the error is: %s\n", err)
+		os.Exit(1)
+	}
+	return datastore.NewCredentialStorage(config.S3ApiServer.DataFolder)
+}
+
+func printAccessKey(accessKey *datastore.AccessKey) {
+	fmt.Printf("Access key id:     %s\n", accessKey.AccessKeyID)
+	fmt.Printf("Secret access key: %s\n", accessKey.SecretAccessKey)
+}
+
+func init() {
+	RootCmd.AddCommand(userCmd)
+	userCmd.AddCommand(userCreateCmd, userListCmd, userDeleteCmd, userRotateKeyCmd)
+
+	userCmd.PersistentFlags().StringP("s3DataFolder", "d", "/data/fakes3", "Data folder for s3")
+	userCreateCmd.Flags().String("account", datastore.DefaultAccountName, "Account of the user")
+}
@@ -23,9 +23,25 @@ type HTTPConfig struct {
 
 // S3ApiServerConfig holds configuration for S3 api server
 type S3ApiServerConfig struct {
-	HTTP           *HTTPConfig `yaml:"http"`
-	AdvertisedAddr string      `yaml:"advertisedAddr"`
-	DataFolder     string      `yaml:"dataFolder"`
+	HTTP              *HTTPConfig `yaml:"http"`
+	AdvertisedAddr    string      `yaml:"advertisedAddr"`
+	DataFolder        string      `yaml:"dataFolder"`
+	AutoCreateBuckets bool        `yaml:"autoCreateBuckets"` // create missing buckets on first write instead of returning NoSuchBucket
+	PreCreateBuckets  []string    `yaml:"preCreateBuckets"`  // buckets to create when the server starts
+	Auth              *AuthConfig `yaml:"auth"`
+}
+
+// AuthConfig holds configuration for request authentication
+type AuthConfig struct {
+	Enabled    bool               `yaml:"enabled"` // verify request signatures, any request is accepted anonymously when false
+	Region     string             `yaml:"region"`  // region requests must be signed for
+	AccessKeys []*AccessKeyConfig `yaml:"accessKeys"`
+}
+
+// AccessKeyConfig holds credentials requests can be signed with
+type AccessKeyConfig struct {
+	AccessKeyID     string `yaml:"accessKeyID"`
+	SecretAccessKey string `yaml:"secretAccessKey"`
 }
 
 // ReadConfig reads configuration from viper
@@ -39,8 +55,15 @@ func ReadConfig() (*Config, error) {
 			HTTP: &HTTPConfig{
 				Addr: ":8000",
 			},
-			AdvertisedAddr: "",
-			DataFolder:     "/data/fakes3",
+			AdvertisedAddr:    "",
+			DataFolder:        "/data/fakes3",
+			AutoCreateBuckets: false,
+			PreCreateBuckets:  []string{},
+			Auth: &AuthConfig{
+				Enabled:    false,
+				Region:     "us-east-1",
+				AccessKeys: []*AccessKeyConfig{},
+			},
 		},
 	}
 	err := viper.Unmarshal(config)
@@ -0,0 +1,218 @@
+package datastore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// BucketStorage stores s3 buckets
+type BucketStorage struct {
+	objectStorageFolder   string
+	metadataStorageFolder string
+	bucketStorageFolder   string
+	autoCreate            bool
+	locks                 *keyLocks // held for reading while writing objects, for writing while deleting the bucket
+}
+
+// BucketInfo holds information about a bucket
+type BucketInfo struct {
+	Name         string    `json:"name"`
+	Location     string    `json:"location"`
+	CreationDate time.Time `json:"creationDate"`
+}
+
+// NewBucketStorage returns new BucketStorage. If autoCreate is true, buckets are created implicitly on first write
+func NewBucketStorage(s3DataFolder string, autoCreate bool) *BucketStorage {
+	return &BucketStorage{
+		objectStorageFolder:   filepath.Join(s3DataFolder, "objects"),
+		metadataStorageFolder: filepath.Join(s3DataFolder, "metadata"),
+		bucketStorageFolder:   filepath.Join(s3DataFolder, "buckets"),
+		autoCreate:            autoCreate,
+		locks:                 newKeyLocks(),
+	}
+}
+
+// CreateBucket creates a new empty bucket
+func (bs *BucketStorage) CreateBucket(bucket, location string) error {
+	err := ValidateBucketName(bucket)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(bs.objectStorageFolder, 0755)
+	if err != nil {
+		return stacktrace.Propagate(err, "Cannot create object storage folder %q", bs.objectStorageFolder)
+	}
+	err = os.MkdirAll(bs.bucketStorageFolder, 0755)
+	if err != nil {
+		return stacktrace.Propagate(err, "Cannot create bucket storage folder %q", bs.bucketStorageFolder)
+	}
+	err = os.Mkdir(bs.bucketFolder(bucket), 0755)
+	if os.IsExist(err) {
+		return stacktrace.NewErrorWithCode(ErrCodeBucketAlreadyExists, "Bucket %q already exists", bucket)
+	}
+	if err != nil {
+		return stacktrace.Propagate(err, "Cannot create bucket %q", bucket)
+	}
+	content, err := json.Marshal(&BucketInfo{
+		Name:         bucket,
+		Location:     location,
+		CreationDate: time.Now().UTC(),
+	})
+	if err != nil {
+		return stacktrace.Propagate(err, "Cannot marshal bucket info for %q", bucket)
+	}
+	err = ioutil.WriteFile(bs.bucketInfoFile(bucket), content, 0644)
+	return stacktrace.Propagate(err, "Cannot write bucket info for %q", bucket)
+}
+
+// PreCreateBuckets creates the given buckets if they do not exist yet
+func (bs *BucketStorage) PreCreateBuckets(buckets []string) error {
+	for _, bucket := range buckets {
+		err := bs.CreateBucket(bucket, "")
+		if err != nil && stacktrace.GetCode(err) != ErrCodeBucketAlreadyExists {
+			return err
+		}
+	}
+	return nil
+}
+
+// EnsureBucket checks that a bucket exists before writing to it. In auto create mode, a missing bucket is created instead
+func (bs *BucketStorage) EnsureBucket(bucket string) error {
+	if !bs.autoCreate {
+		return bs.checkBucket(bucket)
+	}
+	err := bs.CreateBucket(bucket, "")
+	if err != nil && stacktrace.GetCode(err) != ErrCodeBucketAlreadyExists {
+		return err
+	}
+	return nil
+}
+
+// DeleteBucket deletes a bucket. The bucket must not contain any object
+func (bs *BucketStorage) DeleteBucket(bucket string) error {
+	unlock := bs.locks.lock(bucket)
+	defer unlock()
+	err := bs.checkBucket(bucket)
+	if err != nil {
+		return err
+	}
+	bucketFolder := bs.bucketFolder(bucket)
+	empty := true
+	err = filepath.Walk(bucketFolder, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			empty = false
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return stacktrace.Propagate(err, "Cannot read bucket folder %q", bucketFolder)
+	}
+	if !empty {
+		return stacktrace.NewErrorWithCode(ErrCodeBucketNotEmpty, "Bucket %q is not empty", bucket)
+	}
+	err = os.RemoveAll(bucketFolder)
+	if err != nil {
+		return stacktrace.Propagate(err, "Cannot delete bucket folder %q", bucketFolder)
+	}
+	bucketMetadataFolder := filepath.Join(bs.metadataStorageFolder, bucket)
+	err = os.RemoveAll(bucketMetadataFolder)
+	if err != nil {
+		return stacktrace.Propagate(err, "Cannot delete bucket metadata folder %q", bucketMetadataFolder)
+	}
+	err = os.Remove(bs.bucketInfoFile(bucket))
+	if err != nil && !os.IsNotExist(err) {
+		return stacktrace.Propagate(err, "Cannot delete bucket info for %q", bucket)
+	}
+	return nil
+}
+
+// GetBucket returns information about a bucket
+func (bs *BucketStorage) GetBucket(bucket string) (*BucketInfo, error) {
+	err := bs.checkBucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	return bs.readBucketInfo(bucket)
+}
+
+// ListBuckets returns all buckets, sorted by name
+func (bs *BucketStorage) ListBuckets() ([]*BucketInfo, error) {
+	entries, err := ioutil.ReadDir(bs.objectStorageFolder)
+	if os.IsNotExist(err) {
+		return []*BucketInfo{}, nil
+	}
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot read object storage folder %q", bs.objectStorageFolder)
+	}
+	buckets := []*BucketInfo{}
+	for _, entry := range entries {
+		// Legacy buckets with invalid names are left in place by MigrateLayout, they cannot be served
+		if !entry.IsDir() || ValidateBucketName(entry.Name()) != nil {
+			continue
+		}
+		bucketInfo, err := bs.readBucketInfo(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, bucketInfo)
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].Name < buckets[j].Name
+	})
+	return buckets, nil
+}
+
+func (bs *BucketStorage) checkBucket(bucket string) error {
+	err := ValidateBucketName(bucket)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(bs.bucketFolder(bucket))
+	if err != nil || !info.IsDir() {
+		return stacktrace.NewErrorWithCode(ErrCodeNoSuchBucket, "Bucket %q does not exist", bucket)
+	}
+	return nil
+}
+
+// readBucketInfo reads the bucket info file. Buckets created implicitly by older versions have no info file,
+// so their creation date falls back to the modification time of the bucket folder
+func (bs *BucketStorage) readBucketInfo(bucket string) (*BucketInfo, error) {
+	content, err := ioutil.ReadFile(bs.bucketInfoFile(bucket))
+	if os.IsNotExist(err) {
+		info, err := os.Stat(bs.bucketFolder(bucket))
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "Cannot stat bucket folder for %q", bucket)
+		}
+		return &BucketInfo{
+			Name:         bucket,
+			CreationDate: info.ModTime().UTC(),
+		}, nil
+	}
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot read bucket info for %q", bucket)
+	}
+	bucketInfo := &BucketInfo{}
+	err = json.Unmarshal(content, bucketInfo)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Invalid bucket info for %q", bucket)
+	}
+	return bucketInfo, nil
+}
+
+func (bs *BucketStorage) bucketFolder(bucket string) string {
+	return filepath.Join(bs.objectStorageFolder, bucket)
+}
+
+func (bs *BucketStorage) bucketInfoFile(bucket string) string {
+	return filepath.Join(bs.bucketStorageFolder, bucket+".json")
+}
@@ -0,0 +1,85 @@
+package datastore
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Checksum algorithms of the x-amz-checksum-* headers
+const (
+	ChecksumCRC32     = "CRC32"
+	ChecksumCRC32C    = "CRC32C"
+	ChecksumCRC64NVME = "CRC64NVME"
+	ChecksumSHA1      = "SHA1"
+	ChecksumSHA256    = "SHA256"
+)
+
+// Checksum types of multipart objects. Single part objects always have full object checksums
+const (
+	ChecksumTypeFullObject = "FULL_OBJECT"
+	ChecksumTypeComposite  = "COMPOSITE"
+)
+
+// DefaultChecksumAlgorithm is computed for objects uploaded without a checksum, like s3 does
+const DefaultChecksumAlgorithm = ChecksumCRC64NVME
+
+// ChecksumAlgorithms lists the supported checksum algorithms
+var ChecksumAlgorithms = []string{ChecksumCRC32, ChecksumCRC32C, ChecksumCRC64NVME, ChecksumSHA1, ChecksumSHA256}
+
+// crc64NVMETable is the table of the CRC-64/NVME polynomial, in the reversed form used by hash/crc64
+var crc64NVMETable = crc64.MakeTable(0x9a6c9329ac4bc9b5)
+
+// NewChecksumHash returns the hash computing a checksum algorithm, or false if the algorithm is not supported
+func NewChecksumHash(algorithm string) (hash.Hash, bool) {
+	switch algorithm {
+	case ChecksumCRC32:
+		return crc32.NewIEEE(), true
+	case ChecksumCRC32C:
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli)), true
+	case ChecksumCRC64NVME:
+		return crc64.New(crc64NVMETable), true
+	case ChecksumSHA1:
+		return sha1.New(), true
+	case ChecksumSHA256:
+		return sha256.New(), true
+	}
+	return nil, false
+}
+
+// SupportsCompositeChecksum tells if multipart objects can have a composite checksum with an algorithm
+func SupportsCompositeChecksum(algorithm string) bool {
+	return algorithm != ChecksumCRC64NVME
+}
+
+// SupportsFullObjectChecksum tells if multipart objects can have a full object checksum with an algorithm
+func SupportsFullObjectChecksum(algorithm string) bool {
+	return algorithm != ChecksumSHA1 && algorithm != ChecksumSHA256
+}
+
+func encodeChecksum(sum []byte) string {
+	return base64.StdEncoding.EncodeToString(sum)
+}
+
+// compositeChecksum returns the checksum of a multipart object computed from the checksums of its parts:
+// the checksum of their concatenated binary values, followed by the number of parts
+func compositeChecksum(algorithm string, partChecksums []string) (string, error) {
+	hasher, ok := NewChecksumHash(algorithm)
+	if !ok {
+		return "", stacktrace.NewError("Unsupported checksum algorithm %q", algorithm)
+	}
+	for _, partChecksum := range partChecksums {
+		sum, err := base64.StdEncoding.DecodeString(partChecksum)
+		if err != nil {
+			return "", stacktrace.Propagate(err, "Invalid part checksum %q", partChecksum)
+		}
+		hasher.Write(sum)
+	}
+	return fmt.Sprintf("%s-%d", encodeChecksum(hasher.Sum(nil)), len(partChecksums)), nil
+}
@@ -0,0 +1,172 @@
+package datastore
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/palantir/stacktrace"
+)
+
+func TestChecksumHash(t *testing.T) {
+	// Check values of the catalogue of parametrised CRC algorithms, for the 9 ascii bytes "123456789"
+	tests := []struct {
+		algorithm string
+		expected  string
+	}{
+		{ChecksumCRC32, "cbf43926"},
+		{ChecksumCRC32C, "e3069283"},
+		{ChecksumCRC64NVME, "ae8b14860a799888"},
+		{ChecksumSHA1, "f7c3bc1d808e04732adf679965ccc34ca7ae3441"},
+		{ChecksumSHA256, "15e2b0d3c33891ebb0f1ef609ec419420c20e320ce94c65fbc8c3312448eb225"},
+	}
+	for _, test := range tests {
+		hasher, ok := NewChecksumHash(test.algorithm)
+		if !ok {
+			t.Errorf("Algorithm %s is not supported", test.algorithm)
+			continue
+		}
+		hasher.Write([]byte("123456789"))
+		if sum := hex.EncodeToString(hasher.Sum(nil)); sum != test.expected {
+			t.Errorf("%s checksum is %s, expecting %s", test.algorithm, sum, test.expected)
+		}
+	}
+	if _, ok := NewChecksumHash("MD5"); ok {
+		t.Error("Algorithm MD5 is supported")
+	}
+}
+
+func TestCompositeChecksum(t *testing.T) {
+	tests := []struct {
+		algorithm     string
+		partChecksums []string
+		expected      string
+	}{
+		{ChecksumCRC32, []string{"r/zBbw==", "NhCmhg=="}, "QaduHg==-2"},
+		{ChecksumCRC32C, []string{"WpuOeg==", "mnG7TA=="}, "QYpdNA==-2"},
+		{ChecksumSHA1, []string{"YbjWYArJTZEodPVpqTQRIPaAyfg=", "qvTGHdzF6KLavt4PO0gs2a6pQ00="}, "Sc9786yoTVGaHVddVcFc/41FQ9k=-2"},
+		{ChecksumSHA256, []string{"oplo+tLngqqfIECjXwWtuX7Yl56x9XLIyOp4Y34nXzw=", "LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ="}, "SgR6J2QpUvtxUG056/fVnydfChjAOF9iE6spWAp//X8=-2"},
+		// A single part object still has the checksum of its part checksum
+		{ChecksumCRC32, []string{"NhCmhg=="}, "FKTmaw==-1"},
+	}
+	for _, test := range tests {
+		checksum, err := compositeChecksum(test.algorithm, test.partChecksums)
+		if err != nil || checksum != test.expected {
+			t.Errorf("%s composite checksum of %q is %q, error %v, expecting %q", test.algorithm, test.partChecksums, checksum, err, test.expected)
+		}
+	}
+	if _, err := compositeChecksum("MD5", []string{"NhCmhg=="}); err == nil {
+		t.Error("Composite checksum computed with an unsupported algorithm")
+	}
+	if _, err := compositeChecksum(ChecksumCRC32, []string{"not base64"}); err == nil {
+		t.Error("Composite checksum computed from an invalid part checksum")
+	}
+}
+
+func TestMultipartChecksum(t *testing.T) {
+	tests := []struct {
+		algorithm         string
+		checksumType      string
+		expectedAlgorithm string
+		expectedType      string
+	}{
+		{"", "", DefaultChecksumAlgorithm, ChecksumTypeFullObject},
+		{ChecksumCRC32, "", ChecksumCRC32, ChecksumTypeComposite},
+		{ChecksumSHA256, "", ChecksumSHA256, ChecksumTypeComposite},
+		{ChecksumCRC64NVME, "", ChecksumCRC64NVME, ChecksumTypeFullObject},
+		{ChecksumCRC32C, ChecksumTypeFullObject, ChecksumCRC32C, ChecksumTypeFullObject},
+		{ChecksumSHA1, ChecksumTypeComposite, ChecksumSHA1, ChecksumTypeComposite},
+	}
+	for _, test := range tests {
+		algorithm, checksumType := multipartChecksum(&ObjectMetadata{ChecksumAlgorithm: test.algorithm, ChecksumType: test.checksumType})
+		if algorithm != test.expectedAlgorithm || checksumType != test.expectedType {
+			t.Errorf("Upload with algorithm %q and type %q merges to %s %s, expecting %s %s",
+				test.algorithm, test.checksumType, algorithm, checksumType, test.expectedAlgorithm, test.expectedType)
+		}
+	}
+}
+
+// createTwoPartUpload initiates an upload with the given checksum algorithm and type, then stores a first part of
+// MinPartSize bytes "a" and a second part "hello". Returns the upload id and the parts to complete it with
+func createTwoPartUpload(t *testing.T, storages *testStorages, algorithm, checksumType string) (string, []*CompletedPart) {
+	uploadInfo, err := storages.partStorage.CreateUpload(testBucket, "key", "", DefaultIdentity(), &ObjectMetadata{ChecksumAlgorithm: algorithm, ChecksumType: checksumType})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := []*CompletedPart{}
+	for i, content := range []string{strings.Repeat("a", MinPartSize), "hello"} {
+		partInfo, err := storages.partStorage.StorePart(testBucket, "key", uploadInfo.UploadID, i+1, newTestPayload(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, &CompletedPart{PartNumber: i + 1, ETag: partInfo.ETag, Checksum: partInfo.Checksum})
+	}
+	return uploadInfo.UploadID, parts
+}
+
+func TestMergePartsChecksum(t *testing.T) {
+	const expectedETag = "7cbb08aa3c3309d6882c18fcecc4bee7-2"
+	tests := []struct {
+		algorithm             string
+		checksumType          string
+		expectedPartChecksums []string
+		expectedType          string
+		expectedChecksum      string
+	}{
+		{"", "", []string{"PbvLEkWUSgg=", "M3eFcAZSQlc="}, ChecksumTypeFullObject, "xrqTozlh+bk="},
+		{ChecksumCRC64NVME, "", []string{"PbvLEkWUSgg=", "M3eFcAZSQlc="}, ChecksumTypeFullObject, "xrqTozlh+bk="},
+		{ChecksumCRC32, ChecksumTypeFullObject, []string{"r/zBbw==", "NhCmhg=="}, ChecksumTypeFullObject, "dsLl6w=="},
+		{ChecksumCRC32C, ChecksumTypeFullObject, []string{"WpuOeg==", "mnG7TA=="}, ChecksumTypeFullObject, "vzdZqA=="},
+		{ChecksumCRC32, "", []string{"r/zBbw==", "NhCmhg=="}, ChecksumTypeComposite, "QaduHg==-2"},
+		{ChecksumCRC32C, "", []string{"WpuOeg==", "mnG7TA=="}, ChecksumTypeComposite, "QYpdNA==-2"},
+		{ChecksumSHA256, "", []string{"oplo+tLngqqfIECjXwWtuX7Yl56x9XLIyOp4Y34nXzw=", "LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ="}, ChecksumTypeComposite, "SgR6J2QpUvtxUG056/fVnydfChjAOF9iE6spWAp//X8=-2"},
+	}
+	for _, test := range tests {
+		storages, cleanup := newTestStorages(t)
+		uploadID, parts := createTwoPartUpload(t, storages, test.algorithm, test.checksumType)
+		metadata, err := storages.objectStorage.MergeParts(testBucket, "key", uploadID, parts, storages.partStorage)
+		cleanup()
+		if err != nil {
+			t.Errorf("Cannot merge %s %s parts: %s", test.algorithm, test.checksumType, err)
+			continue
+		}
+		if metadata.ETag != expectedETag {
+			t.Errorf("Merged %s %s parts have ETag %q, expecting %q", test.algorithm, test.checksumType, metadata.ETag, expectedETag)
+		}
+		if metadata.ChecksumType != test.expectedType || metadata.Checksum != test.expectedChecksum ||
+			strings.Join(metadata.PartChecksums, ",") != strings.Join(test.expectedPartChecksums, ",") {
+			t.Errorf("Merged %s %s parts have %s checksum %q of parts %q, expecting %s checksum %q of parts %q", test.algorithm, test.checksumType,
+				metadata.ChecksumType, metadata.Checksum, metadata.PartChecksums, test.expectedType, test.expectedChecksum, test.expectedPartChecksums)
+		}
+	}
+}
+
+func TestValidatePartsChecksum(t *testing.T) {
+	storages, cleanup := newTestStorages(t)
+	defer cleanup()
+	uploadID, parts := createTwoPartUpload(t, storages, ChecksumCRC32, "")
+	tests := []struct {
+		name         string
+		checksums    []string
+		expectedCode stacktrace.ErrorCode
+	}{
+		{"Listed", []string{"r/zBbw==", "NhCmhg=="}, stacktrace.NoCode},
+		{"NotListed", []string{"", ""}, stacktrace.NoCode},
+		{"SomeListed", []string{"", "NhCmhg=="}, stacktrace.NoCode},
+		{"Swapped", []string{"NhCmhg==", "r/zBbw=="}, ErrCodeInvalidPart},
+		{"WrongLastPart", []string{"r/zBbw==", "AAAAAA=="}, ErrCodeInvalidPart},
+	}
+	for _, test := range tests {
+		listed := []*CompletedPart{}
+		for i, part := range parts {
+			listed = append(listed, &CompletedPart{PartNumber: part.PartNumber, ETag: part.ETag, Checksum: test.checksums[i]})
+		}
+		_, err := storages.partStorage.validateParts(uploadID, listed)
+		switch {
+		case test.expectedCode == stacktrace.NoCode && err != nil:
+			t.Errorf("%s: %s", test.name, err)
+		case test.expectedCode != stacktrace.NoCode && (err == nil || stacktrace.GetCode(err) != test.expectedCode):
+			t.Errorf("%s: returned %v, expecting error code %d", test.name, err, test.expectedCode)
+		}
+	}
+}
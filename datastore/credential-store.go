@@ -0,0 +1,359 @@
+package datastore
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+const (
+	credentialsFile = "credentials.json"
+	// DefaultAccountName is the name of the account owning the access keys of the config file, and users created without an account
+	DefaultAccountName = "fakes3"
+	defaultAccountID   = "000000000000"
+)
+
+// validIdentityName matches the names of accounts and users, following the iam user name rules
+var validIdentityName = regexp.MustCompile(`^[\w+=,.@-]{1,64}$`)
+
+// Account owns the buckets, objects and uploads created by its users
+type Account struct {
+	ID              string `json:"id"` // 12 digit account id
+	Name            string `json:"name"`
+	CanonicalUserID string `json:"canonicalUserId"` // id of the account in Owner elements
+}
+
+// User belongs to an account and signs requests with its access keys
+type User struct {
+	Name       string       `json:"name"`
+	Account    string       `json:"account"` // name of the account
+	Created    time.Time    `json:"created"`
+	AccessKeys []*AccessKey `json:"accessKeys"`
+}
+
+// AccessKey holds credentials requests can be signed with
+type AccessKey struct {
+	AccessKeyID     string    `json:"accessKeyId"`
+	SecretAccessKey string    `json:"secretAccessKey"`
+	Created         time.Time `json:"created"`
+}
+
+// Principal identifies an account or a user in the Owner and Initiator elements of s3 responses
+type Principal struct {
+	ID          string `json:"id"`
+	DisplayName string `json:"displayName"`
+}
+
+// Identity is the caller of a request
+type Identity struct {
+	Account *Account
+	User    *User // nil for the root credentials of the account
+}
+
+// Owner returns the principal of the account of the identity
+func (i *Identity) Owner() *Principal {
+	return &Principal{
+		ID:          i.Account.CanonicalUserID,
+		DisplayName: i.Account.Name,
+	}
+}
+
+// Initiator returns the principal of the identity itself, which is the owner for root credentials
+func (i *Identity) Initiator() *Principal {
+	if i.User == nil {
+		return i.Owner()
+	}
+	return &Principal{
+		ID:          fmt.Sprintf("arn:aws:iam::%s:user/%s", i.Account.ID, i.User.Name),
+		DisplayName: i.User.Name,
+	}
+}
+
+// DefaultIdentity returns the root identity of the default account, the caller of anonymous requests
+func DefaultIdentity() *Identity {
+	canonicalUserID := sha256.Sum256([]byte(DefaultAccountName))
+	return &Identity{
+		Account: &Account{
+			ID:              defaultAccountID,
+			Name:            DefaultAccountName,
+			CanonicalUserID: hex.EncodeToString(canonicalUserID[:]),
+		},
+	}
+}
+
+type credentials struct {
+	Accounts []*Account `json:"accounts"`
+	Users    []*User    `json:"users"`
+}
+
+func (c *credentials) account(name string) *Account {
+	for _, account := range c.Accounts {
+		if account.Name == name {
+			return account
+		}
+	}
+	if name == DefaultAccountName {
+		return DefaultIdentity().Account
+	}
+	return nil
+}
+
+func (c *credentials) user(name string) (int, *User) {
+	for i, user := range c.Users {
+		if user.Name == name {
+			return i, user
+		}
+	}
+	return -1, nil
+}
+
+// CredentialStorage stores accounts and users in a file of the data folder. The file is replaced atomically
+// on every change and read again when it changes, so a running server picks up changes made by other processes
+type CredentialStorage struct {
+	credentialsFile string
+	tmpFolder       string
+	mutex           sync.Mutex
+	fileInfo        os.FileInfo // credentials file the cache was read from, nil if it did not exist
+	cache           *credentials
+}
+
+// NewCredentialStorage returns new CredentialStorage
+func NewCredentialStorage(s3DataFolder string) *CredentialStorage {
+	return &CredentialStorage{
+		credentialsFile: filepath.Join(s3DataFolder, credentialsFile),
+		tmpFolder:       filepath.Join(s3DataFolder, "tmp"),
+	}
+}
+
+// LookupAccessKey returns the identity of an access key and its secret. The identity is nil if the access key does not exist
+func (cs *CredentialStorage) LookupAccessKey(accessKeyID string) (*Identity, string, error) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	creds, err := cs.refresh()
+	if err != nil {
+		return nil, "", err
+	}
+	for _, user := range creds.Users {
+		for _, accessKey := range user.AccessKeys {
+			if accessKey.AccessKeyID == accessKeyID {
+				account := creds.account(user.Account)
+				if account == nil {
+					return nil, "", stacktrace.NewError("User %q belongs to unknown account %q", user.Name, user.Account)
+				}
+				return &Identity{Account: account, User: user}, accessKey.SecretAccessKey, nil
+			}
+		}
+	}
+	return nil, "", nil
+}
+
+// ListUsers returns all users sorted by name, with the accounts they belong to
+func (cs *CredentialStorage) ListUsers() ([]*Identity, error) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	creds, err := cs.refresh()
+	if err != nil {
+		return nil, err
+	}
+	identities := []*Identity{}
+	for _, user := range creds.Users {
+		identities = append(identities, &Identity{Account: creds.account(user.Account), User: user})
+	}
+	sort.Slice(identities, func(i, j int) bool {
+		return identities[i].User.Name < identities[j].User.Name
+	})
+	return identities, nil
+}
+
+// CreateUser creates a user with a new access key, in the default account if accountName is empty.
+// The account is created if it does not exist
+func (cs *CredentialStorage) CreateUser(userName, accountName string) (*Identity, *AccessKey, error) {
+	if accountName == "" {
+		accountName = DefaultAccountName
+	}
+	if !validIdentityName.MatchString(userName) {
+		return nil, nil, stacktrace.NewErrorWithCode(ErrCodeInvalidIdentityName, "Invalid user name %q", userName)
+	}
+	if !validIdentityName.MatchString(accountName) {
+		return nil, nil, stacktrace.NewErrorWithCode(ErrCodeInvalidIdentityName, "Invalid account name %q", accountName)
+	}
+	var identity *Identity
+	var accessKey *AccessKey
+	err := cs.update(func(creds *credentials) error {
+		if _, user := creds.user(userName); user != nil {
+			return stacktrace.NewErrorWithCode(ErrCodeUserAlreadyExists, "User %q already exists", userName)
+		}
+		account := creds.account(accountName)
+		if account == nil {
+			var err error
+			account, err = newAccount(accountName)
+			if err != nil {
+				return err
+			}
+			creds.Accounts = append(creds.Accounts, account)
+		}
+		var err error
+		accessKey, err = newAccessKey()
+		if err != nil {
+			return err
+		}
+		user := &User{
+			Name:       userName,
+			Account:    accountName,
+			Created:    time.Now().UTC(),
+			AccessKeys: []*AccessKey{accessKey},
+		}
+		creds.Users = append(creds.Users, user)
+		identity = &Identity{Account: account, User: user}
+		return nil
+	})
+	return identity, accessKey, err
+}
+
+// DeleteUser deletes a user and its access keys. Its account is kept, it still owns what the user created
+func (cs *CredentialStorage) DeleteUser(userName string) error {
+	return cs.update(func(creds *credentials) error {
+		i, user := creds.user(userName)
+		if user == nil {
+			return stacktrace.NewErrorWithCode(ErrCodeNoSuchUser, "User %q does not exist", userName)
+		}
+		creds.Users = append(creds.Users[:i], creds.Users[i+1:]...)
+		return nil
+	})
+}
+
+// RotateAccessKey replaces the access keys of a user with a new one and returns it
+func (cs *CredentialStorage) RotateAccessKey(userName string) (*AccessKey, error) {
+	var accessKey *AccessKey
+	err := cs.update(func(creds *credentials) error {
+		_, user := creds.user(userName)
+		if user == nil {
+			return stacktrace.NewErrorWithCode(ErrCodeNoSuchUser, "User %q does not exist", userName)
+		}
+		var err error
+		accessKey, err = newAccessKey()
+		if err != nil {
+			return err
+		}
+		user.AccessKeys = []*AccessKey{accessKey}
+		return nil
+	})
+	return accessKey, err
+}
+
+// refresh returns the content of the credentials file, read again if it changed since the last call.
+// Must be called with the mutex held
+func (cs *CredentialStorage) refresh() (*credentials, error) {
+	fileInfo, err := os.Stat(cs.credentialsFile)
+	if os.IsNotExist(err) {
+		cs.fileInfo, cs.cache = nil, &credentials{}
+		return cs.cache, nil
+	}
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot stat credentials file %q", cs.credentialsFile)
+	}
+	// The file is replaced on every change, comparing the modification time only could miss changes made within its precision
+	if cs.cache != nil && cs.fileInfo != nil && os.SameFile(cs.fileInfo, fileInfo) && cs.fileInfo.ModTime().Equal(fileInfo.ModTime()) {
+		return cs.cache, nil
+	}
+	content, err := ioutil.ReadFile(cs.credentialsFile)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot read credentials file %q", cs.credentialsFile)
+	}
+	creds := &credentials{}
+	err = json.Unmarshal(content, creds)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Invalid credentials file %q", cs.credentialsFile)
+	}
+	cs.fileInfo, cs.cache = fileInfo, creds
+	return creds, nil
+}
+
+// update applies a change to the credentials and writes them back
+func (cs *CredentialStorage) update(change func(*credentials) error) error {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	creds, err := cs.refresh()
+	if err != nil {
+		return err
+	}
+	// The cache is only replaced once the change is written
+	content, err := json.Marshal(creds)
+	if err != nil {
+		return stacktrace.Propagate(err, "Cannot marshal credentials")
+	}
+	changed := &credentials{}
+	err = json.Unmarshal(content, changed)
+	if err != nil {
+		return stacktrace.Propagate(err, "Cannot copy credentials")
+	}
+	err = change(changed)
+	if err != nil {
+		return err
+	}
+	content, err = json.MarshalIndent(changed, "", "  ")
+	if err != nil {
+		return stacktrace.Propagate(err, "Cannot marshal credentials")
+	}
+	tmpPath, err := writeTmpFile(cs.tmpFolder, "credentials-", content)
+	if err != nil {
+		return err
+	}
+	// Secrets must not be readable by other users
+	err = os.Chmod(tmpPath, 0600)
+	if err != nil {
+		os.Remove(tmpPath)
+		return stacktrace.Propagate(err, "Cannot restrict permissions of %q", tmpPath)
+	}
+	err = commitFile(tmpPath, cs.credentialsFile)
+	if err != nil {
+		return err
+	}
+	cs.fileInfo, cs.cache = nil, nil
+	return nil
+}
+
+func newAccount(name string) (*Account, error) {
+	id, err := rand.Int(rand.Reader, big.NewInt(1e12))
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot generate account id")
+	}
+	canonicalUserID := make([]byte, 32)
+	_, err = rand.Read(canonicalUserID)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot generate canonical user id")
+	}
+	return &Account{
+		ID:              fmt.Sprintf("%012d", id),
+		Name:            name,
+		CanonicalUserID: hex.EncodeToString(canonicalUserID),
+	}, nil
+}
+
+// newAccessKey generates an access key shaped like aws ones, a 20 characters id starting with AKIA and a 40 characters secret
+func newAccessKey() (*AccessKey, error) {
+	random := make([]byte, 40)
+	_, err := rand.Read(random)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot generate access key")
+	}
+	return &AccessKey{
+		AccessKeyID:     "AKIA" + base32.StdEncoding.EncodeToString(random[:10])[:16],
+		SecretAccessKey: base64.StdEncoding.EncodeToString(random[10:]),
+		Created:         time.Now().UTC(),
+	}, nil
+}
@@ -0,0 +1,148 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/palantir/stacktrace"
+)
+
+// newTestCredentialStorages returns two credential storages sharing a data folder, like a running server and a user command
+func newTestCredentialStorages(t *testing.T) (*CredentialStorage, *CredentialStorage, func()) {
+	dataFolder, err := ioutil.TempDir("", "fakes3-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewCredentialStorage(dataFolder), NewCredentialStorage(dataFolder), func() { os.RemoveAll(dataFolder) }
+}
+
+// checkAccessKey checks that an access key identifies a user with the given secret, or does not exist if userName is empty
+func checkAccessKey(t *testing.T, cs *CredentialStorage, accessKey *AccessKey, userName string) {
+	identity, secretAccessKey, err := cs.LookupAccessKey(accessKey.AccessKeyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	switch {
+	case userName == "" && identity != nil:
+		t.Errorf("Access key %q still identifies user %q", accessKey.AccessKeyID, identity.User.Name)
+	case userName == "":
+	case identity == nil:
+		t.Errorf("Access key %q of user %q does not exist", accessKey.AccessKeyID, userName)
+	case identity.User.Name != userName || secretAccessKey != accessKey.SecretAccessKey:
+		t.Errorf("Access key %q identifies user %q with secret %q", accessKey.AccessKeyID, identity.User.Name, secretAccessKey)
+	}
+}
+
+func TestCredentialStorageSeesChangesOfOtherInstances(t *testing.T) {
+	server, command, cleanup := newTestCredentialStorages(t)
+	defer cleanup()
+	// Caches the missing credentials file
+	identities, err := server.ListUsers()
+	if err != nil || len(identities) != 0 {
+		t.Fatalf("Listed %d users, error %v", len(identities), err)
+	}
+
+	_, accessKey, err := command.CreateUser("alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAccessKey(t, server, accessKey, "alice")
+
+	rotatedKey, err := command.RotateAccessKey("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAccessKey(t, server, accessKey, "")
+	checkAccessKey(t, server, rotatedKey, "alice")
+
+	// Changes made by the other instance are not lost when the first one writes
+	_, bobKey, err := server.CreateUser("bob", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAccessKey(t, command, bobKey, "bob")
+	checkAccessKey(t, command, rotatedKey, "alice")
+
+	err = command.DeleteUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAccessKey(t, server, rotatedKey, "")
+	checkAccessKey(t, server, bobKey, "bob")
+	identities, err = server.ListUsers()
+	if err != nil || len(identities) != 1 || identities[0].User.Name != "bob" {
+		t.Errorf("Listed %v users after deleting alice, error %v", identities, err)
+	}
+}
+
+func TestCredentialStorageUsers(t *testing.T) {
+	cs, _, cleanup := newTestCredentialStorages(t)
+	defer cleanup()
+	identity, accessKey, err := cs.CreateUser("alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *identity.Account != *DefaultIdentity().Account {
+		t.Errorf("User created without account belongs to %+v, expecting the default account", identity.Account)
+	}
+	if len(accessKey.AccessKeyID) != 20 || len(accessKey.SecretAccessKey) != 40 {
+		t.Errorf("Access key %q with secret %q is not shaped like aws ones", accessKey.AccessKeyID, accessKey.SecretAccessKey)
+	}
+	bob, _, err := cs.CreateUser("bob", "team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	carol, _, err := cs.CreateUser("carol", "team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *bob.Account != *carol.Account || bob.Account.Name != "team" || bob.Account.ID == DefaultIdentity().Account.ID {
+		t.Errorf("Users of account team belong to %+v and %+v", bob.Account, carol.Account)
+	}
+	if bob.Initiator().ID != "arn:aws:iam::"+bob.Account.ID+":user/bob" || bob.Owner().ID != bob.Account.CanonicalUserID {
+		t.Errorf("User bob has initiator %+v and owner %+v", bob.Initiator(), bob.Owner())
+	}
+
+	_, _, existingErr := cs.CreateUser("alice", "team")
+	_, _, invalidUserErr := cs.CreateUser("alice smith", "")
+	_, _, invalidAccountErr := cs.CreateUser("dave", "my/account")
+	_, rotateErr := cs.RotateAccessKey("dave")
+	errorTests := []struct {
+		name         string
+		err          error
+		expectedCode stacktrace.ErrorCode
+	}{
+		{"ExistingUser", existingErr, ErrCodeUserAlreadyExists},
+		{"InvalidUserName", invalidUserErr, ErrCodeInvalidIdentityName},
+		{"InvalidAccountName", invalidAccountErr, ErrCodeInvalidIdentityName},
+		{"DeleteUnknownUser", cs.DeleteUser("dave"), ErrCodeNoSuchUser},
+		{"RotateUnknownUser", rotateErr, ErrCodeNoSuchUser},
+	}
+	for _, test := range errorTests {
+		if test.err == nil || stacktrace.GetCode(test.err) != test.expectedCode {
+			t.Errorf("%s: returned %v, expecting error code %d", test.name, test.err, test.expectedCode)
+		}
+	}
+
+	// Deleting a user keeps its account
+	err = cs.DeleteUser("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dave, _, err := cs.CreateUser("dave", "team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *dave.Account != *carol.Account {
+		t.Errorf("User of account team created after a deletion belongs to %+v, expecting %+v", dave.Account, carol.Account)
+	}
+
+	info, err := os.Stat(cs.credentialsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Credentials file has mode %v, expecting it to be only readable by its owner", info.Mode())
+	}
+}
@@ -0,0 +1,51 @@
+package datastore
+
+import "github.com/palantir/stacktrace"
+
+// Error codes attached to errors returned by the storages, so callers can map them to s3 errors
+const (
+	// ErrCodeNoSuchBucket is returned when the bucket does not exist
+	ErrCodeNoSuchBucket stacktrace.ErrorCode = iota
+	// ErrCodeNoSuchKey is returned when the object does not exist
+	ErrCodeNoSuchKey
+	// ErrCodeBucketAlreadyExists is returned when creating a bucket that already exists
+	ErrCodeBucketAlreadyExists
+	// ErrCodeBucketNotEmpty is returned when deleting a bucket that still has objects
+	ErrCodeBucketNotEmpty
+	// ErrCodeInvalidPart is returned when a listed part was not uploaded or its ETag does not match
+	ErrCodeInvalidPart
+	// ErrCodeInvalidPartOrder is returned when listed parts are not in ascending order
+	ErrCodeInvalidPartOrder
+	// ErrCodeEntityTooSmall is returned when a part other than the last one is smaller than MinPartSize, or a payload is smaller than allowed
+	ErrCodeEntityTooSmall
+	// ErrCodeNoSuchUpload is returned when a multipart upload does not exist or was initiated for another object
+	ErrCodeNoSuchUpload
+	// ErrCodeInvalidBucketName is returned when a bucket name does not follow the s3 naming rules
+	ErrCodeInvalidBucketName
+	// ErrCodeKeyTooLong is returned when an object key is longer than MaxKeyLength
+	ErrCodeKeyTooLong
+	// ErrCodeInvalidObjectKey is returned when an object key is empty
+	ErrCodeInvalidObjectKey
+	// ErrCodeIncompleteBody is returned when a request body is shorter than its announced size
+	ErrCodeIncompleteBody
+	// ErrCodeBadDigest is returned when a payload does not match its Content-MD5
+	ErrCodeBadDigest
+	// ErrCodeSHA256Mismatch is returned when a payload does not match its x-amz-content-sha256
+	ErrCodeSHA256Mismatch
+	// ErrCodeChecksumMismatch is returned when a payload does not match its x-amz-checksum-* value
+	ErrCodeChecksumMismatch
+	// ErrCodeChecksumAlgorithmMismatch is returned when a part checksum uses another algorithm than its upload
+	ErrCodeChecksumAlgorithmMismatch
+	// ErrCodeMalformedPayload is returned when the reader of a payload cannot decode its framing
+	ErrCodeMalformedPayload
+	// ErrCodePayloadSignatureMismatch is returned when the reader of a payload finds a chunk whose signature does not match
+	ErrCodePayloadSignatureMismatch
+	// ErrCodeEntityTooLarge is returned when a payload is larger than allowed
+	ErrCodeEntityTooLarge
+	// ErrCodeNoSuchUser is returned when a user does not exist in the credential storage
+	ErrCodeNoSuchUser
+	// ErrCodeUserAlreadyExists is returned when creating a user that already exists
+	ErrCodeUserAlreadyExists
+	// ErrCodeInvalidIdentityName is returned when a user or account name does not follow the iam naming rules
+	ErrCodeInvalidIdentityName
+)
@@ -0,0 +1,173 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/palantir/stacktrace"
+)
+
+// MaxKeyLength is the maximum length of an object key, in bytes
+const MaxKeyLength = 1024
+
+// Object keys are stored losslessly: each "/" separated segment of a key is escaped to [A-Za-z0-9-_.] and
+// maps to a folder with dirSuffix, except the last one which maps to a file with objectSuffix. This way
+// "a/b" (a@/b.obj) and "a/b/c" (a@/b@/c.obj) can coexist. Escaped segments too long for a file name are
+// split into folders with chunkSuffix.
+const (
+	dirSuffix          = "@"
+	objectSuffix       = ".obj"
+	chunkSuffix        = "&"
+	emptySegment       = "%"
+	maxEncodedChunkLen = 200
+)
+
+var (
+	bucketNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+	ipAddressPattern  = regexp.MustCompile(`^[0-9]+\.[0-9]+\.[0-9]+\.[0-9]+$`)
+)
+
+// ValidateBucketName checks a bucket name against the s3 bucket naming rules
+func ValidateBucketName(bucket string) error {
+	if !bucketNamePattern.MatchString(bucket) ||
+		strings.Contains(bucket, "..") ||
+		ipAddressPattern.MatchString(bucket) ||
+		strings.HasPrefix(bucket, "xn--") ||
+		strings.HasPrefix(bucket, "sthree-") ||
+		strings.HasSuffix(bucket, "-s3alias") ||
+		strings.HasSuffix(bucket, "--ol-s3") {
+		return stacktrace.NewErrorWithCode(ErrCodeInvalidBucketName, "Invalid bucket name %q", bucket)
+	}
+	return nil
+}
+
+// ValidateObjectKey checks that an object key is not empty nor longer than MaxKeyLength
+func ValidateObjectKey(objectKey string) error {
+	if objectKey == "" {
+		return stacktrace.NewErrorWithCode(ErrCodeInvalidObjectKey, "Object key is empty")
+	}
+	if len(objectKey) > MaxKeyLength {
+		return stacktrace.NewErrorWithCode(ErrCodeKeyTooLong, "Object key is %d bytes long", len(objectKey))
+	}
+	return nil
+}
+
+// objectKeyPath maps an object key to its file in the folder of a bucket under root
+func objectKeyPath(root, bucket, objectKey string) (string, error) {
+	err := ValidateBucketName(bucket)
+	if err != nil {
+		return "", err
+	}
+	err = ValidateObjectKey(objectKey)
+	if err != nil {
+		return "", err
+	}
+	segments := strings.Split(objectKey, "/")
+	components := []string{root, bucket}
+	for i, segment := range segments {
+		suffix := dirSuffix
+		if i == len(segments)-1 {
+			suffix = objectSuffix
+		}
+		components = append(components, encodeSegment(segment, suffix)...)
+	}
+	return filepath.Join(components...), nil
+}
+
+// prefixFolder returns the deepest folder of a bucket under root that holds all keys starting with prefix
+func prefixFolder(root, bucket, prefix string) string {
+	components := []string{root, bucket}
+	segments := strings.Split(prefix, "/")
+	for _, segment := range segments[:len(segments)-1] {
+		components = append(components, encodeSegment(segment, dirSuffix)...)
+	}
+	return filepath.Join(components...)
+}
+
+// decodeKeyPath returns the object key stored at a path relative to its bucket folder.
+// Returns false for files that are not objects
+func decodeKeyPath(relPath string) (string, bool) {
+	components := strings.Split(filepath.ToSlash(relPath), "/")
+	lastComponent := components[len(components)-1]
+	if !strings.HasSuffix(lastComponent, objectSuffix) {
+		return "", false
+	}
+	components[len(components)-1] = strings.TrimSuffix(lastComponent, objectSuffix) + dirSuffix
+	segments := []string{}
+	pendingSegment := ""
+	for _, component := range components {
+		switch {
+		case strings.HasSuffix(component, chunkSuffix):
+			pendingSegment += strings.TrimSuffix(component, chunkSuffix)
+		case strings.HasSuffix(component, dirSuffix):
+			segment, ok := decodeSegment(pendingSegment + strings.TrimSuffix(component, dirSuffix))
+			if !ok {
+				return "", false
+			}
+			segments = append(segments, segment)
+			pendingSegment = ""
+		default:
+			return "", false
+		}
+	}
+	return strings.Join(segments, "/"), true
+}
+
+// encodeSegment escapes a key segment and splits it in path components, the last one ending with suffix
+func encodeSegment(segment, suffix string) []string {
+	encoded := emptySegment
+	if segment != "" {
+		var buf bytes.Buffer
+		for i := 0; i < len(segment); i++ {
+			c := segment[i]
+			// A leading dot is escaped so "." and ".." segments never reach the file system
+			if isUnescapedByte(c) && !(i == 0 && c == '.') {
+				buf.WriteByte(c)
+			} else {
+				fmt.Fprintf(&buf, "%%%02X", c)
+			}
+		}
+		encoded = buf.String()
+	}
+	components := []string{}
+	for len(encoded) > maxEncodedChunkLen {
+		components = append(components, encoded[:maxEncodedChunkLen]+chunkSuffix)
+		encoded = encoded[maxEncodedChunkLen:]
+	}
+	return append(components, encoded+suffix)
+}
+
+func decodeSegment(encoded string) (string, bool) {
+	if encoded == emptySegment {
+		return "", true
+	}
+	var buf bytes.Buffer
+	for i := 0; i < len(encoded); i++ {
+		c := encoded[i]
+		if c != '%' {
+			if !isUnescapedByte(c) {
+				return "", false
+			}
+			buf.WriteByte(c)
+			continue
+		}
+		if i+2 >= len(encoded) {
+			return "", false
+		}
+		decoded, err := hex.DecodeString(encoded[i+1 : i+3])
+		if err != nil {
+			return "", false
+		}
+		buf.Write(decoded)
+		i += 2
+	}
+	return buf.String(), true
+}
+
+func isUnescapedByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.'
+}
@@ -0,0 +1,102 @@
+package datastore
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestObjectKeyPathRoundTrip(t *testing.T) {
+	keys := []string{
+		"key",
+		"a/b/c",
+		"a/",
+		"a//b",
+		"//",
+		"/a",
+		".",
+		"..",
+		"a/./b",
+		"a/../b",
+		"../../etc/passwd",
+		".hidden",
+		"%",
+		"%25",
+		"@",
+		"a@/b",
+		"&",
+		"a&/b",
+		".obj",
+		"a.obj/b",
+		"space and ünïcödé",
+		strings.Repeat("x", 300),
+		strings.Repeat("%", 300) + "/b",
+		strings.Repeat("a/", 300),
+	}
+	for _, key := range keys {
+		path, err := objectKeyPath("root", testBucket, key)
+		if err != nil {
+			t.Errorf("Cannot map key %q: %s", key, err)
+			continue
+		}
+		relPath, err := filepath.Rel(filepath.Join("root", testBucket), path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, component := range strings.Split(filepath.ToSlash(relPath), "/") {
+			if component == "" || component == "." || component == ".." || len(component) > 255 {
+				t.Errorf("Key %q maps to invalid path component %q", key, component)
+			}
+		}
+		decoded, ok := decodeKeyPath(relPath)
+		if !ok || decoded != key {
+			t.Errorf("Key %q maps to %q which decodes to %q, %v", key, relPath, decoded, ok)
+		}
+	}
+}
+
+func TestObjectKeyPathsDoNotCollide(t *testing.T) {
+	keys := []string{"a", "a/", "a/b", "a//b", "a/b/c", "%", "%25", ".", "%2E", "a@", "a&", strings.Repeat("x", 400)}
+	paths := make(map[string]string)
+	for _, key := range keys {
+		path, err := objectKeyPath("root", testBucket, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if other, ok := paths[path]; ok {
+			t.Errorf("Keys %q and %q both map to %q", key, other, path)
+		}
+		paths[path] = key
+	}
+}
+
+func TestDecodeKeyPathRejectsNonObjects(t *testing.T) {
+	relPaths := []string{
+		"key",
+		"a@",
+		"a@/b",
+		"a/b.obj",
+		"a&",
+		"a%2.obj",
+		"a%ZZ.obj",
+		"a b.obj",
+	}
+	for _, relPath := range relPaths {
+		if key, ok := decodeKeyPath(relPath); ok {
+			t.Errorf("%q decodes to key %q", relPath, key)
+		}
+	}
+}
+
+func TestObjectKeyPathValidation(t *testing.T) {
+	for _, bucket := range []string{"My_Bucket", "UPPER", "ab", "a..b", "192.168.0.1", "-bucket"} {
+		if _, err := objectKeyPath("root", bucket, "key"); err == nil {
+			t.Errorf("Bucket name %q was accepted", bucket)
+		}
+	}
+	for _, key := range []string{"", strings.Repeat("x", MaxKeyLength+1)} {
+		if _, err := objectKeyPath("root", testBucket, key); err == nil {
+			t.Errorf("Key of %d bytes was accepted", len(key))
+		}
+	}
+}
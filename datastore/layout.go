@@ -0,0 +1,274 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/palantir/stacktrace"
+)
+
+const (
+	layoutFile    = "layout"
+	layoutVersion = "2"
+	// stagedMarkerFile is written in the staging folder once every bucket is staged
+	stagedMarkerFile = "staged"
+	// unmigratedFolder holds the legacy files that cannot be migrated, with their legacy path
+	unmigratedFolder = "unmigrated"
+)
+
+// CheckLayout checks that a data folder uses the current key to file layout. A data folder
+// without any object is marked as using it, objects stored by older versions must be migrated with MigrateLayout
+func CheckLayout(s3DataFolder string) error {
+	current, err := hasCurrentLayout(s3DataFolder)
+	if err != nil || current {
+		return err
+	}
+	hasObjects := false
+	objectStorageFolder := filepath.Join(s3DataFolder, "objects")
+	err = filepath.Walk(objectStorageFolder, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			hasObjects = true
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return stacktrace.Propagate(err, "Cannot read object storage folder %q", objectStorageFolder)
+	}
+	if hasObjects {
+		return stacktrace.NewError("Data folder %q uses a legacy layout, run the migrate command first", s3DataFolder)
+	}
+	return writeLayoutFile(s3DataFolder)
+}
+
+// MigrationResult reports what MigrateLayout did
+type MigrationResult struct {
+	Migrated       int      // number of objects migrated by this run
+	SkippedBuckets []string // buckets left in place because their name is not a valid bucket name, they cannot be served anymore
+	SkippedObjects []string // "<bucket>/<path>" of legacy files whose path is not a valid key, moved to the unmigrated folder
+}
+
+// MigrateLayout moves objects and metadata stored with the legacy layout, where keys were used as paths, to the
+// current layout. Migrating a data folder already using the current layout does nothing, and a migration that failed
+// can be run again: every bucket is moved to a staging folder before any legacy folder is replaced, so legacy and
+// migrated paths never mix in a bucket
+func MigrateLayout(s3DataFolder string) (*MigrationResult, error) {
+	result := &MigrationResult{SkippedBuckets: []string{}, SkippedObjects: []string{}}
+	current, err := hasCurrentLayout(s3DataFolder)
+	if err != nil || current {
+		return result, err
+	}
+	objectStorageFolder := filepath.Join(s3DataFolder, "objects")
+	metadataStorageFolder := filepath.Join(s3DataFolder, "metadata")
+	stagingFolder := filepath.Join(s3DataFolder, "migrate")
+	stagingObjectFolder := filepath.Join(stagingFolder, "objects")
+	stagingMetadataFolder := filepath.Join(stagingFolder, "metadata")
+	// Once written, legacy folders are being replaced and must not be walked again
+	stagedFile := filepath.Join(stagingFolder, stagedMarkerFile)
+	_, err = os.Stat(stagedFile)
+	staged := err == nil
+	buckets, err := migratedBuckets(objectStorageFolder, stagingObjectFolder)
+	if err != nil {
+		return result, err
+	}
+	for _, bucket := range buckets {
+		// Older versions accepted any bucket name
+		if ValidateBucketName(bucket) != nil {
+			logrus.Warnf("Skipping bucket %q, its name is not a valid bucket name", bucket)
+			result.SkippedBuckets = append(result.SkippedBuckets, bucket)
+			continue
+		}
+		if staged {
+			continue
+		}
+		err = stageBucket(s3DataFolder, bucket, result)
+		if err != nil {
+			return result, stacktrace.Propagate(err, "Cannot migrate bucket %q", bucket)
+		}
+	}
+	if !staged {
+		err = createParentDirForFile(stagedFile)
+		if err != nil {
+			return result, err
+		}
+		err = ioutil.WriteFile(stagedFile, nil, 0644)
+		if err != nil {
+			return result, stacktrace.Propagate(err, "Cannot write %q", stagedFile)
+		}
+	}
+	// A bucket is replaced once its staging folder is gone, so a new run only replaces the remaining ones
+	stagedBuckets, err := migratedBuckets(stagingObjectFolder)
+	if err != nil {
+		return result, err
+	}
+	for _, bucket := range stagedBuckets {
+		// Objects are replaced last, their staging folder tells the bucket is not done
+		err = replaceFolder(filepath.Join(stagingMetadataFolder, bucket), filepath.Join(metadataStorageFolder, bucket))
+		if err != nil {
+			return result, err
+		}
+		err = replaceFolder(filepath.Join(stagingObjectFolder, bucket), filepath.Join(objectStorageFolder, bucket))
+		if err != nil {
+			return result, err
+		}
+	}
+	err = os.RemoveAll(stagingFolder)
+	if err != nil {
+		return result, stacktrace.Propagate(err, "Cannot remove staging folder %q", stagingFolder)
+	}
+	return result, writeLayoutFile(s3DataFolder)
+}
+
+// stageBucket moves the objects and metadata of a legacy bucket to the staging folder with the current layout.
+// Files whose path is not a valid key are moved to the unmigrated folder instead
+func stageBucket(s3DataFolder, bucket string, result *MigrationResult) error {
+	bucketFolder := filepath.Join(s3DataFolder, "objects", bucket)
+	metadataFolder := filepath.Join(s3DataFolder, "metadata", bucket)
+	stagingObjectFolder := filepath.Join(s3DataFolder, "migrate", "objects")
+	stagingMetadataFolder := filepath.Join(s3DataFolder, "migrate", "metadata")
+	// Empty buckets must survive the migration too
+	for _, folder := range []string{stagingObjectFolder, stagingMetadataFolder} {
+		err := os.MkdirAll(filepath.Join(folder, bucket), 0755)
+		if err != nil {
+			return stacktrace.Propagate(err, "Cannot create staging folder for bucket %q", bucket)
+		}
+	}
+	return filepath.Walk(bucketFolder, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		relPath, err := filepath.Rel(bucketFolder, path)
+		if err != nil {
+			return err
+		}
+		objectKey := filepath.ToSlash(relPath)
+		legacyMetadataPath := filepath.Join(metadataFolder, relPath)
+		_, statErr := os.Stat(legacyMetadataPath)
+		hasMetadata := statErr == nil
+		if ValidateObjectKey(objectKey) != nil {
+			logrus.Warnf("Skipping object %q of bucket %q, its path is not a valid key", objectKey, bucket)
+			result.SkippedObjects = append(result.SkippedObjects, bucket+"/"+objectKey)
+			unmigratedRoot := filepath.Join(s3DataFolder, unmigratedFolder)
+			err = moveFile(path, filepath.Join(unmigratedRoot, "objects", bucket, relPath))
+			if err == nil && hasMetadata {
+				err = moveFile(legacyMetadataPath, filepath.Join(unmigratedRoot, "metadata", bucket, relPath))
+			}
+			return err
+		}
+		err = moveToLayout(path, stagingObjectFolder, bucket, objectKey)
+		if err != nil {
+			return err
+		}
+		if hasMetadata {
+			err = moveToLayout(legacyMetadataPath, stagingMetadataFolder, bucket, objectKey)
+			if err != nil {
+				return err
+			}
+		}
+		logrus.Debugf("Migrated object %q of bucket %q", objectKey, bucket)
+		result.Migrated++
+		return nil
+	})
+}
+
+// migratedBuckets returns the buckets in the object storage folder, plus those left in the staging folder by an interrupted migration
+func migratedBuckets(folders ...string) ([]string, error) {
+	seen := make(map[string]bool)
+	buckets := []string{}
+	for _, folder := range folders {
+		entries, err := ioutil.ReadDir(folder)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "Cannot read folder %q", folder)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() && !seen[entry.Name()] {
+				seen[entry.Name()] = true
+				buckets = append(buckets, entry.Name())
+			}
+		}
+	}
+	return buckets, nil
+}
+
+func moveToLayout(legacyPath, root, bucket, objectKey string) error {
+	path, err := objectKeyPath(root, bucket, objectKey)
+	if err != nil {
+		return err
+	}
+	return moveFile(legacyPath, path)
+}
+
+func moveFile(from, to string) error {
+	err := createParentDirForFile(to)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(from, to)
+	return stacktrace.Propagate(err, "Cannot move %q to %q", from, to)
+}
+
+// replaceFolder replaces a legacy bucket folder, now only holding empty folders, with its migrated version.
+// Does nothing if the staging folder is gone, the folder has already been replaced.
+// The modification time is kept as it is the creation date of buckets without info file
+func replaceFolder(stagingFolder, folder string) error {
+	_, err := os.Stat(stagingFolder)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	legacyInfo, statErr := os.Stat(folder)
+	err = os.RemoveAll(folder)
+	if err != nil {
+		return stacktrace.Propagate(err, "Cannot remove legacy folder %q", folder)
+	}
+	err = createParentDirForFile(folder)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(stagingFolder, folder)
+	if err != nil {
+		return stacktrace.Propagate(err, "Cannot move migrated folder %q", stagingFolder)
+	}
+	if statErr == nil {
+		err = os.Chtimes(folder, legacyInfo.ModTime(), legacyInfo.ModTime())
+		return stacktrace.Propagate(err, "Cannot restore modification time of %q", folder)
+	}
+	return nil
+}
+
+func hasCurrentLayout(s3DataFolder string) (bool, error) {
+	content, err := ioutil.ReadFile(filepath.Join(s3DataFolder, layoutFile))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, stacktrace.Propagate(err, "Cannot read layout file in %q", s3DataFolder)
+	}
+	return strings.TrimSpace(string(content)) == layoutVersion, nil
+}
+
+func writeLayoutFile(s3DataFolder string) error {
+	err := os.MkdirAll(s3DataFolder, 0755)
+	if err != nil {
+		return stacktrace.Propagate(err, "Cannot create data folder %q", s3DataFolder)
+	}
+	err = ioutil.WriteFile(filepath.Join(s3DataFolder, layoutFile), []byte(layoutVersion+"\n"), 0644)
+	return stacktrace.Propagate(err, "Cannot write layout file in %q", s3DataFolder)
+}
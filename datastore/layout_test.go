@@ -0,0 +1,211 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// writeLegacyFile writes a file of a data folder written by an older version
+func writeLegacyFile(t *testing.T, dataFolder, relPath, content string) {
+	path := filepath.Join(dataFolder, filepath.FromSlash(relPath))
+	err := createParentDirForFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newLegacyDataFolder returns a tmp data folder without layout file
+func newLegacyDataFolder(t *testing.T) string {
+	logrus.SetLevel(logrus.ErrorLevel)
+	dataFolder, err := ioutil.TempDir("", "fakes3-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dataFolder
+}
+
+// checkMigratedObject checks the content and the content type of an object of a migrated data folder
+func checkMigratedObject(t *testing.T, dataFolder, bucket, objectKey, expectedContent, expectedContentType string) {
+	objectStorage := NewObjectStorage(dataFolder, NewBucketStorage(dataFolder, false))
+	f, info, err := objectStorage.OpenObject(bucket, objectKey)
+	if err != nil {
+		t.Errorf("Cannot open migrated object %q of bucket %q: %s", objectKey, bucket, err)
+		return
+	}
+	defer f.Close()
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != expectedContent || info.Metadata.ContentType != expectedContentType {
+		t.Errorf("Migrated object %q has content %q and metadata %+v", objectKey, content, info.Metadata)
+	}
+}
+
+func listMigratedKeys(t *testing.T, dataFolder, bucket string) []string {
+	objects, err := NewObjectStorage(dataFolder, NewBucketStorage(dataFolder, false)).ListObjects(bucket, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+	return keys
+}
+
+func TestMigrateLayout(t *testing.T) {
+	dataFolder := newLegacyDataFolder(t)
+	defer os.RemoveAll(dataFolder)
+	longPath := strings.Repeat(strings.Repeat("x", 250)+"/", 5) + "long"
+	writeLegacyFile(t, dataFolder, "objects/legacy-bucket/key", "root object")
+	writeLegacyFile(t, dataFolder, "objects/legacy-bucket/a/b/c.txt", "nested object")
+	writeLegacyFile(t, dataFolder, "objects/legacy-bucket/a/.hidden", "dot file")
+	writeLegacyFile(t, dataFolder, "objects/legacy-bucket/"+longPath, "long path")
+	writeLegacyFile(t, dataFolder, "metadata/legacy-bucket/a/b/c.txt", `{"etag":"etag","contentType":"text/plain"}`)
+	writeLegacyFile(t, dataFolder, "metadata/legacy-bucket/"+longPath, `{"etag":"etag"}`)
+	writeLegacyFile(t, dataFolder, "objects/Legacy_Bucket/key", "invalid bucket name")
+	err := os.MkdirAll(filepath.Join(dataFolder, "objects", "empty-bucket"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = CheckLayout(dataFolder)
+	if err == nil {
+		t.Fatal("CheckLayout accepted a legacy data folder")
+	}
+	result, err := MigrateLayout(dataFolder)
+	if err != nil {
+		t.Fatalf("Cannot migrate: %s", err)
+	}
+	if result.Migrated != 3 {
+		t.Errorf("Migrated %d objects, expecting 3", result.Migrated)
+	}
+	if !reflect.DeepEqual(result.SkippedBuckets, []string{"Legacy_Bucket"}) {
+		t.Errorf("Skipped buckets %v, expecting the bucket with an invalid name", result.SkippedBuckets)
+	}
+	if !reflect.DeepEqual(result.SkippedObjects, []string{"legacy-bucket/" + longPath}) {
+		t.Errorf("Skipped objects %v, expecting the object with a path too long", result.SkippedObjects)
+	}
+	err = CheckLayout(dataFolder)
+	if err != nil {
+		t.Fatalf("CheckLayout rejected the migrated data folder: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(dataFolder, "objects", "Legacy_Bucket", "key")); err != nil {
+		t.Errorf("Bucket with an invalid name was not left as is: %s", err)
+	}
+	for _, folder := range []string{"objects", "metadata"} {
+		if _, err := os.Stat(filepath.Join(dataFolder, unmigratedFolder, folder, "legacy-bucket", longPath)); err != nil {
+			t.Errorf("Object with a path too long was not kept: %s", err)
+		}
+	}
+
+	bucketStorage := NewBucketStorage(dataFolder, false)
+	buckets, err := bucketStorage.ListBuckets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucketNames := []string{}
+	for _, bucket := range buckets {
+		bucketNames = append(bucketNames, bucket.Name)
+	}
+	if !reflect.DeepEqual(bucketNames, []string{"empty-bucket", "legacy-bucket"}) {
+		t.Errorf("Listed buckets %q, expecting the buckets with a valid name", bucketNames)
+	}
+	expectedKeys := []string{"a/.hidden", "a/b/c.txt", "key"}
+	if keys := listMigratedKeys(t, dataFolder, "legacy-bucket"); !reflect.DeepEqual(keys, expectedKeys) {
+		t.Errorf("Listed keys %q, expecting %q", keys, expectedKeys)
+	}
+	checkMigratedObject(t, dataFolder, "legacy-bucket", "a/b/c.txt", "nested object", "text/plain")
+
+	result, err = MigrateLayout(dataFolder)
+	if err != nil || result.Migrated != 0 {
+		t.Errorf("Migrating again migrated %d objects, error %v", result.Migrated, err)
+	}
+}
+
+func TestMigrateLayoutAfterStagingFailure(t *testing.T) {
+	dataFolder := newLegacyDataFolder(t)
+	defer os.RemoveAll(dataFolder)
+	writeLegacyFile(t, dataFolder, "objects/bk1/dir/file.txt", "first bucket")
+	writeLegacyFile(t, dataFolder, "metadata/bk1/dir/file.txt", `{"etag":"etag","contentType":"text/plain"}`)
+	writeLegacyFile(t, dataFolder, "objects/bk2/file.txt", "second bucket")
+	// A file where the staging folder of bk2 goes makes its migration fail after bk1 is staged
+	writeLegacyFile(t, dataFolder, "migrate/metadata/bk2", "")
+	_, err := MigrateLayout(dataFolder)
+	if err == nil {
+		t.Fatal("Migration did not fail")
+	}
+	err = os.Remove(filepath.Join(dataFolder, "migrate", "metadata", "bk2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := MigrateLayout(dataFolder)
+	if err != nil {
+		t.Fatalf("Cannot migrate again: %s", err)
+	}
+	if result.Migrated != 1 {
+		t.Errorf("Migrating again migrated %d objects, expecting the object left", result.Migrated)
+	}
+	if keys := listMigratedKeys(t, dataFolder, "bk1"); !reflect.DeepEqual(keys, []string{"dir/file.txt"}) {
+		t.Errorf("Listed keys %q of the bucket staged by the failed migration", keys)
+	}
+	checkMigratedObject(t, dataFolder, "bk1", "dir/file.txt", "first bucket", "text/plain")
+	checkMigratedObject(t, dataFolder, "bk2", "file.txt", "second bucket", "")
+}
+
+func TestMigrateLayoutAfterReplacementFailure(t *testing.T) {
+	dataFolder := newLegacyDataFolder(t)
+	defer os.RemoveAll(dataFolder)
+	writeLegacyFile(t, dataFolder, "objects/bk1/dir/file.txt", "first bucket")
+	writeLegacyFile(t, dataFolder, "metadata/bk1/dir/file.txt", `{"etag":"etag","contentType":"text/plain"}`)
+	writeLegacyFile(t, dataFolder, "objects/bk2/dir/file.txt", "second bucket")
+	writeLegacyFile(t, dataFolder, "metadata/bk2/dir/file.txt", `{"etag":"etag","contentType":"text/html"}`)
+	_, err := MigrateLayout(dataFolder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Puts the data folder back in the state of a migration stopped after replacing bk1 and the metadata of bk2
+	err = os.Remove(filepath.Join(dataFolder, layoutFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeLegacyFile(t, dataFolder, "migrate/"+stagedMarkerFile, "")
+	err = os.MkdirAll(filepath.Join(dataFolder, "migrate", "objects"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Rename(filepath.Join(dataFolder, "objects", "bk2"), filepath.Join(dataFolder, "migrate", "objects", "bk2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(filepath.Join(dataFolder, "objects", "bk2", "dir"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := MigrateLayout(dataFolder)
+	if err != nil {
+		t.Fatalf("Cannot migrate again: %s", err)
+	}
+	if result.Migrated != 0 {
+		t.Errorf("Migrating again migrated %d objects, expecting none", result.Migrated)
+	}
+	for _, bucket := range []string{"bk1", "bk2"} {
+		if keys := listMigratedKeys(t, dataFolder, bucket); !reflect.DeepEqual(keys, []string{"dir/file.txt"}) {
+			t.Errorf("Listed keys %q in bucket %q", keys, bucket)
+		}
+	}
+	checkMigratedObject(t, dataFolder, "bk1", "dir/file.txt", "first bucket", "text/plain")
+	checkMigratedObject(t, dataFolder, "bk2", "dir/file.txt", "second bucket", "text/html")
+}
@@ -0,0 +1,67 @@
+package datastore
+
+import "sync"
+
+// keyLocks hands out a read/write lock per name, created on demand and dropped once unused
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.RWMutex
+	refs int
+}
+
+func newKeyLocks() *keyLocks {
+	return &keyLocks{
+		locks: make(map[string]*keyLock),
+	}
+}
+
+// lock locks a name for writing and returns the function unlocking it
+func (kl *keyLocks) lock(name string) func() {
+	l := kl.acquire(name)
+	l.Lock()
+	return func() {
+		l.Unlock()
+		kl.release(name)
+	}
+}
+
+// rlock locks a name for reading and returns the function unlocking it
+func (kl *keyLocks) rlock(name string) func() {
+	l := kl.acquire(name)
+	l.RLock()
+	return func() {
+		l.RUnlock()
+		kl.release(name)
+	}
+}
+
+func (kl *keyLocks) acquire(name string) *keyLock {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+	l, ok := kl.locks[name]
+	if !ok {
+		l = &keyLock{}
+		kl.locks[name] = l
+	}
+	l.refs++
+	return l
+}
+
+func (kl *keyLocks) release(name string) {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+	l := kl.locks[name]
+	l.refs--
+	if l.refs == 0 {
+		delete(kl.locks, name)
+	}
+}
+
+// objectLockName returns the lock name of an object. Bucket names cannot contain "/"
+func objectLockName(bucket, objectKey string) string {
+	return bucket + "/" + objectKey
+}
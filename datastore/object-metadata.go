@@ -0,0 +1,84 @@
+package datastore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/palantir/stacktrace"
+)
+
+// ObjectMetadata holds the metadata stored alongside an object
+type ObjectMetadata struct {
+	ETag               string            `json:"etag"` // hex md5 of the content, followed by -N for multipart objects
+	ContentType        string            `json:"contentType,omitempty"`
+	ContentEncoding    string            `json:"contentEncoding,omitempty"`
+	ContentDisposition string            `json:"contentDisposition,omitempty"`
+	ContentLanguage    string            `json:"contentLanguage,omitempty"`
+	CacheControl       string            `json:"cacheControl,omitempty"`
+	Expires            string            `json:"expires,omitempty"`
+	UserMetadata       map[string]string `json:"userMetadata,omitempty"` // x-amz-meta-* headers, keyed by lower case name without prefix
+	Tags               map[string]string `json:"tags,omitempty"`
+	PartSizes          []int64           `json:"partSizes,omitempty"` // sizes of the parts of a multipart object, in order
+	ChecksumAlgorithm  string            `json:"checksumAlgorithm,omitempty"`
+	ChecksumType       string            `json:"checksumType,omitempty"`
+	Checksum           string            `json:"checksum,omitempty"`      // base64, followed by -N for composite checksums
+	PartChecksums      []string          `json:"partChecksums,omitempty"` // checksums of the parts of a multipart object, in order
+}
+
+func (o *ObjectStorage) metadataPath(bucket, objectKey string) (string, error) {
+	return objectKeyPath(o.metadataStorageFolder, bucket, objectKey)
+}
+
+// readMetadata reads the metadata of an object. Objects stored by older versions have no metadata file, empty metadata is returned for them
+func (o *ObjectStorage) readMetadata(bucket, objectKey string) (*ObjectMetadata, error) {
+	metadataPath, err := o.metadataPath(bucket, objectKey)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(metadataPath)
+	if os.IsNotExist(err) {
+		return &ObjectMetadata{}, nil
+	}
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot read metadata file %q", metadataPath)
+	}
+	metadata := &ObjectMetadata{}
+	err = json.Unmarshal(content, metadata)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Invalid metadata file %q", metadataPath)
+	}
+	return metadata, nil
+}
+
+// writeMetadataTmp writes the metadata of an object to a tmp file, to be moved in place with commitMetadata once the object is stored
+func (o *ObjectStorage) writeMetadataTmp(metadata *ObjectMetadata) (string, error) {
+	content, err := json.Marshal(metadata)
+	if err != nil {
+		return "", stacktrace.Propagate(err, "Cannot marshal object metadata")
+	}
+	return writeTmpFile(o.tmpFolder, "metadata-", content)
+}
+
+func (o *ObjectStorage) commitMetadata(bucket, objectKey, metadataTmpPath string) error {
+	metadataPath, err := o.metadataPath(bucket, objectKey)
+	if err != nil {
+		os.Remove(metadataTmpPath)
+		return err
+	}
+	return commitFile(metadataTmpPath, metadataPath)
+}
+
+func (o *ObjectStorage) deleteMetadata(bucket, objectKey string) error {
+	metadataPath, err := o.metadataPath(bucket, objectKey)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(metadataPath)
+	if err != nil && !os.IsNotExist(err) {
+		return stacktrace.Propagate(err, "Cannot delete metadata file %q", metadataPath)
+	}
+	removeEmptyParents(metadataPath, filepath.Join(o.metadataStorageFolder, bucket))
+	return nil
+}
@@ -1,9 +1,13 @@
 package datastore
 
 import (
+	"encoding/hex"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/palantir/stacktrace"
@@ -11,86 +15,394 @@ import (
 
 // ObjectStorage stores s3 objects
 type ObjectStorage struct {
-	objectStorageFolder string
-	tmpFolder           string
+	objectStorageFolder   string
+	metadataStorageFolder string
+	tmpFolder             string
+	bucketStorage         *BucketStorage
+	locks                 *keyLocks
+}
+
+// ObjectInfo holds information about a stored object
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	Metadata     *ObjectMetadata
 }
 
 // NewObjectStorage returns new ObjectStorage
-func NewObjectStorage(s3DataFolder string) *ObjectStorage {
+func NewObjectStorage(s3DataFolder string, bucketStorage *BucketStorage) *ObjectStorage {
 	return &ObjectStorage{
-		objectStorageFolder: filepath.Join(s3DataFolder, "objects"),
-		tmpFolder:           filepath.Join(s3DataFolder, "tmp"),
+		objectStorageFolder:   filepath.Join(s3DataFolder, "objects"),
+		metadataStorageFolder: filepath.Join(s3DataFolder, "metadata"),
+		tmpFolder:             filepath.Join(s3DataFolder, "tmp"),
+		bucketStorage:         bucketStorage,
+		locks:                 newKeyLocks(),
 	}
 }
 
-// MergeParts merges upload parts to create a new object
-func (o *ObjectStorage) MergeParts(bucket, objectKey, uploadID string, partStorage *PartStorage) error {
-	objectTmpPath := filepath.Join(o.tmpFolder, bucket, objectKey)
-	err := createParentDirForFile(objectTmpPath)
+// MergeParts merges upload parts to create a new object and returns the stored metadata
+func (o *ObjectStorage) MergeParts(bucket, objectKey, uploadID string, parts []*CompletedPart, partStorage *PartStorage) (*ObjectMetadata, error) {
+	err := o.bucketStorage.EnsureBucket(bucket)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	w, err := os.Create(objectTmpPath)
+	uploadInfo, err := partStorage.GetUpload(bucket, objectKey, uploadID)
 	if err != nil {
-		return stacktrace.Propagate(err, "Cannot create object tmp path %q", objectTmpPath)
+		return nil, err
 	}
-	err = partStorage.MergeParts(uploadID, w)
+	metadata := uploadInfo.Metadata
+	objectPath, err := o.objectPath(bucket, objectKey)
 	if err != nil {
-		w.Close()
-		os.Remove(objectTmpPath)
+		return nil, err
+	}
+	checksumAlgorithm, checksumType := multipartChecksum(metadata)
+	checksumHasher, ok := NewChecksumHash(checksumAlgorithm)
+	if !ok {
+		return nil, stacktrace.NewError("Unsupported checksum algorithm %q", checksumAlgorithm)
+	}
+	w, err := createTmpFile(o.tmpFolder, "object-")
+	if err != nil {
+		return nil, err
+	}
+	var sink io.Writer = w
+	if checksumType == ChecksumTypeFullObject {
+		sink = io.MultiWriter(w, checksumHasher)
+	}
+	closed := false
+	// The object is committed while the upload is still locked, the upload is kept if this fails
+	err = partStorage.MergeParts(bucket, objectKey, uploadID, parts, sink, func(etag string, partInfos []*PartInfo) error {
+		metadata.ETag = etag
+		metadata.PartSizes = make([]int64, 0, len(partInfos))
+		metadata.PartChecksums = make([]string, 0, len(partInfos))
+		for _, partInfo := range partInfos {
+			metadata.PartSizes = append(metadata.PartSizes, partInfo.Size)
+			partChecksum := ""
+			if partInfo.ChecksumAlgorithm == checksumAlgorithm {
+				partChecksum = partInfo.Checksum
+			}
+			metadata.PartChecksums = append(metadata.PartChecksums, partChecksum)
+		}
+		metadata.ChecksumAlgorithm = checksumAlgorithm
+		metadata.ChecksumType = checksumType
+		if checksumType == ChecksumTypeFullObject {
+			metadata.Checksum = encodeChecksum(checksumHasher.Sum(nil))
+		} else {
+			var err error
+			metadata.Checksum, err = compositeChecksum(checksumAlgorithm, metadata.PartChecksums)
+			if err != nil {
+				return err
+			}
+		}
+		closed = true
+		err := syncAndClose(w)
+		if err != nil {
+			return err
+		}
+		_, err = o.commitObject(bucket, objectKey, objectPath, w.Name(), metadata)
 		return err
+	})
+	if err != nil {
+		if !closed {
+			w.Close()
+		}
+		// Already removed or moved in place if the error happened while committing
+		os.Remove(w.Name())
+		return nil, err
+	}
+	logrus.Debugf("Successfully merged object to %q", objectPath)
+	return metadata, nil
+}
+
+// multipartChecksum returns the checksum algorithm and type of an object merged from the parts of an upload
+func multipartChecksum(uploadMetadata *ObjectMetadata) (string, string) {
+	checksumAlgorithm := uploadMetadata.ChecksumAlgorithm
+	if checksumAlgorithm == "" {
+		return DefaultChecksumAlgorithm, ChecksumTypeFullObject
+	}
+	checksumType := uploadMetadata.ChecksumType
+	if checksumType == "" {
+		checksumType = ChecksumTypeComposite
+		if !SupportsCompositeChecksum(checksumAlgorithm) {
+			checksumType = ChecksumTypeFullObject
+		}
+	}
+	return checksumAlgorithm, checksumType
+}
+
+// PutObject stores an object with its metadata and returns the stored object info
+func (o *ObjectStorage) PutObject(bucket, objectKey string, payload *Payload, metadata *ObjectMetadata) (*ObjectInfo, error) {
+	err := o.bucketStorage.EnsureBucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	if metadata == nil {
+		metadata = &ObjectMetadata{}
+	}
+	objectPath, err := o.objectPath(bucket, objectKey)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := writeTmpPayload(o.tmpFolder, "object-", payload)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot store object %q to bucket %q", objectKey, bucket)
 	}
-	objectPath := filepath.Join(o.objectStorageFolder, bucket, objectKey)
-	err = createParentDirForFile(objectPath)
+	metadata.ETag = hex.EncodeToString(stored.md5)
+	metadata.PartSizes = nil
+	metadata.ChecksumAlgorithm = stored.checksumAlgorithm
+	metadata.ChecksumType = ChecksumTypeFullObject
+	metadata.Checksum = stored.checksum
+	metadata.PartChecksums = nil
+	return o.commitObject(bucket, objectKey, objectPath, stored.tmpPath, metadata)
+}
+
+// commitObject moves a complete object from the tmp folder in place along with its metadata, and returns its info.
+// Concurrent writers of a key each commit a complete object under the object lock, the last one to commit wins like in s3
+func (o *ObjectStorage) commitObject(bucket, objectKey, objectPath, objectTmpPath string, metadata *ObjectMetadata) (*ObjectInfo, error) {
+	metadataTmpPath, err := o.writeMetadataTmp(metadata)
 	if err != nil {
 		os.Remove(objectTmpPath)
-		return err
+		return nil, err
 	}
-	err = os.Rename(objectTmpPath, objectPath)
+	unlock := o.lockObject(bucket, objectKey)
+	defer unlock()
+	// The bucket may have been deleted while the object was written
+	err = o.bucketStorage.checkBucket(bucket)
 	if err != nil {
 		os.Remove(objectTmpPath)
-		return stacktrace.Propagate(err, "Cannot move object tmp path %q", objectTmpPath)
+		os.Remove(metadataTmpPath)
+		return nil, err
 	}
-	logrus.Debugf("Successfully merged object to %q", objectPath)
-	return nil
+	err = commitFile(objectTmpPath, objectPath)
+	if err != nil {
+		os.Remove(metadataTmpPath)
+		return nil, err
+	}
+	err = o.commitMetadata(bucket, objectKey, metadataTmpPath)
+	if err != nil {
+		return nil, err
+	}
+	return o.storedObjectInfo(objectKey, objectPath, metadata)
 }
 
-// PutObject stores an object
-func (o *ObjectStorage) PutObject(bucket, objectKey string, source io.Reader) error {
-	objectPath := filepath.Join(o.objectStorageFolder, bucket, objectKey)
-	err := createParentDirForFile(objectPath)
+// UpdateMetadata replaces the metadata of an existing object, keeping its content, ETag, checksum and part layout
+func (o *ObjectStorage) UpdateMetadata(bucket, objectKey string, metadata *ObjectMetadata) (*ObjectInfo, error) {
+	unlock := o.lockObject(bucket, objectKey)
+	defer unlock()
+	objectInfo, err := o.objectInfo(bucket, objectKey)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	w, err := os.Create(objectPath)
+	metadata.ETag = objectInfo.Metadata.ETag
+	metadata.PartSizes = objectInfo.Metadata.PartSizes
+	metadata.ChecksumAlgorithm = objectInfo.Metadata.ChecksumAlgorithm
+	metadata.ChecksumType = objectInfo.Metadata.ChecksumType
+	metadata.Checksum = objectInfo.Metadata.Checksum
+	metadata.PartChecksums = objectInfo.Metadata.PartChecksums
+	metadataTmpPath, err := o.writeMetadataTmp(metadata)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer w.Close()
-	_, err = io.Copy(w, source)
-	return stacktrace.Propagate(err, "Cannot store object %q to bucket %q", objectKey, bucket)
+	err = o.commitMetadata(bucket, objectKey, metadataTmpPath)
+	if err != nil {
+		return nil, err
+	}
+	objectPath, err := o.objectPath(bucket, objectKey)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	err = os.Chtimes(objectPath, now, now)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot update modification time of %q", objectPath)
+	}
+	return o.storedObjectInfo(objectKey, objectPath, metadata)
 }
 
 // DeleteObject deletes an object
 func (o *ObjectStorage) DeleteObject(bucket, objectKey string) error {
-	objectPath := filepath.Join(o.objectStorageFolder, bucket, objectKey)
-	_, err := os.Stat(objectPath)
+	err := o.bucketStorage.checkBucket(bucket)
+	if err != nil {
+		return err
+	}
+	objectPath, err := o.objectPath(bucket, objectKey)
+	if err != nil {
+		return err
+	}
+	unlock := o.lockObject(bucket, objectKey)
+	defer unlock()
+	_, err = os.Stat(objectPath)
 	if err != nil {
 		return nil
 	}
 	err = os.Remove(objectPath)
-	return stacktrace.Propagate(err, "Cannot delete object %q from bucket %q", objectKey, bucket)
+	if err != nil {
+		return stacktrace.Propagate(err, "Cannot delete object %q from bucket %q", objectKey, bucket)
+	}
+	removeEmptyParents(objectPath, filepath.Join(o.objectStorageFolder, bucket))
+	return o.deleteMetadata(bucket, objectKey)
+}
+
+// GetObjectInfo returns information about an object
+func (o *ObjectStorage) GetObjectInfo(bucket, objectKey string) (*ObjectInfo, error) {
+	unlock := o.locks.rlock(objectLockName(bucket, objectKey))
+	defer unlock()
+	return o.objectInfo(bucket, objectKey)
 }
 
-// GetObjectFilePath returns absolute path to a object. Will return empty string if file not found or is not a file
-func (o *ObjectStorage) GetObjectFilePath(bucket, objectKey string) string {
-	objectPath := filepath.Join(o.objectStorageFolder, bucket, objectKey)
+func (o *ObjectStorage) objectInfo(bucket, objectKey string) (*ObjectInfo, error) {
+	err := o.bucketStorage.checkBucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	objectPath, err := o.objectPath(bucket, objectKey)
+	if err != nil {
+		return nil, err
+	}
 	info, err := os.Stat(objectPath)
+	if err != nil || info.IsDir() {
+		return nil, stacktrace.NewErrorWithCode(ErrCodeNoSuchKey, "Object %q not found in bucket %q", objectKey, bucket)
+	}
+	return o.newObjectInfo(bucket, objectKey, objectPath, info)
+}
+
+// OpenObject opens an object for reading. The caller must close the returned file.
+// The file keeps the content matching the returned info even if the object is replaced or deleted meanwhile
+func (o *ObjectStorage) OpenObject(bucket, objectKey string) (*os.File, *ObjectInfo, error) {
+	unlock := o.locks.rlock(objectLockName(bucket, objectKey))
+	defer unlock()
+	err := o.bucketStorage.checkBucket(bucket)
+	if err != nil {
+		return nil, nil, err
+	}
+	objectPath, err := o.objectPath(bucket, objectKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(objectPath)
+	if err != nil {
+		return nil, nil, stacktrace.NewErrorWithCode(ErrCodeNoSuchKey, "Object %q not found in bucket %q", objectKey, bucket)
+	}
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		f.Close()
+		return nil, nil, stacktrace.NewErrorWithCode(ErrCodeNoSuchKey, "Object %q not found in bucket %q", objectKey, bucket)
+	}
+	objectInfo, err := o.newObjectInfo(bucket, objectKey, objectPath, info)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, objectInfo, nil
+}
+
+// ListObjects returns all objects in a bucket whose key starts with prefix, sorted by key in byte order
+func (o *ObjectStorage) ListObjects(bucket, prefix string) ([]*ObjectInfo, error) {
+	err := o.bucketStorage.checkBucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	bucketFolder := filepath.Join(o.objectStorageFolder, bucket)
+	// Only walk the deepest folder that can contain keys with this prefix
+	walkRoot := prefixFolder(o.objectStorageFolder, bucket, prefix)
+	objects := []*ObjectInfo{}
+	err = filepath.Walk(walkRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		relPath, err := filepath.Rel(bucketFolder, path)
+		if err != nil {
+			return err
+		}
+		objectKey, ok := decodeKeyPath(relPath)
+		if !ok || !strings.HasPrefix(objectKey, prefix) {
+			return nil
+		}
+		objectInfo, err := o.listedObjectInfo(bucket, objectKey, path)
+		if err != nil {
+			return err
+		}
+		if objectInfo == nil {
+			return nil
+		}
+		objects = append(objects, objectInfo)
+		return nil
+	})
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot list objects in bucket %q", bucket)
+	}
+	// Walk orders entries per folder, which differs from the byte order of full keys ("a-b" < "a/b")
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	return objects, nil
+}
+
+// listedObjectInfo returns the info of an object found while listing a bucket, or nil if it was deleted meanwhile
+func (o *ObjectStorage) listedObjectInfo(bucket, objectKey, objectPath string) (*ObjectInfo, error) {
+	unlock := o.locks.rlock(objectLockName(bucket, objectKey))
+	defer unlock()
+	// The object may have been replaced since the walk saw it, stat it again under the lock so size and metadata agree
+	info, err := os.Stat(objectPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot stat object %q", objectPath)
+	}
+	return o.newObjectInfo(bucket, objectKey, objectPath, info)
+}
+
+// lockObject locks an object for writing, and its bucket against deletion
+func (o *ObjectStorage) lockObject(bucket, objectKey string) func() {
+	unlockBucket := o.bucketStorage.locks.rlock(bucket)
+	unlockObject := o.locks.lock(objectLockName(bucket, objectKey))
+	return func() {
+		unlockObject()
+		unlockBucket()
+	}
+}
+
+func (o *ObjectStorage) objectPath(bucket, objectKey string) (string, error) {
+	return objectKeyPath(o.objectStorageFolder, bucket, objectKey)
+}
+
+// storedObjectInfo returns the info of an object just written with the given metadata
+func (o *ObjectStorage) storedObjectInfo(objectKey, objectPath string, metadata *ObjectMetadata) (*ObjectInfo, error) {
+	info, err := os.Stat(objectPath)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot stat stored object %q", objectPath)
+	}
+	return &ObjectInfo{
+		Key:          objectKey,
+		Size:         info.Size(),
+		LastModified: info.ModTime(),
+		Metadata:     metadata,
+	}, nil
+}
+
+func (o *ObjectStorage) newObjectInfo(bucket, objectKey, objectPath string, info os.FileInfo) (*ObjectInfo, error) {
+	metadata, err := o.readMetadata(bucket, objectKey)
 	if err != nil {
-		return ""
+		return nil, err
 	}
-	if info.IsDir() {
-		return ""
+	// Objects stored by older versions have no stored ETag, compute it from the content so it stays stable
+	if metadata.ETag == "" {
+		metadata.ETag, err = fileMD5(objectPath)
+		if err != nil {
+			return nil, err
+		}
 	}
-	return objectPath
+	return &ObjectInfo{
+		Key:          objectKey,
+		Size:         info.Size(),
+		LastModified: info.ModTime(),
+		Metadata:     metadata,
+	}, nil
 }
@@ -1,6 +1,9 @@
 package datastore
 
 import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -9,66 +12,415 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/palantir/stacktrace"
+	uuid "github.com/satori/go.uuid"
 )
 
+const (
+	uploadInfoFile = "upload.json"
+	partInfoSuffix = ".json"
+)
+
+// UploadInfo holds information about a multipart upload in progress
+type UploadInfo struct {
+	UploadID  string          `json:"uploadId"`
+	Bucket    string          `json:"bucket"`
+	Key       string          `json:"key"`
+	Initiated time.Time       `json:"initiated"`
+	Initiator string          `json:"initiator"` // access key id of the client which initiated the upload
+	Metadata  *ObjectMetadata `json:"metadata"`  // metadata given at initiation, applied to the merged object
+	// Identity of the initiator and its account, nil for uploads initiated by older versions
+	InitiatorPrincipal *Principal `json:"initiatorPrincipal,omitempty"`
+	Owner              *Principal `json:"owner,omitempty"`
+}
+
+// MinPartSize is the minimum size of all parts but the last one of a multipart upload
+const MinPartSize = 5 * 1024 * 1024
+
+// PartInfo holds information about an uploaded part
+type PartInfo struct {
+	PartNumber        int       `json:"partNumber"`
+	ETag              string    `json:"etag"`
+	Size              int64     `json:"size"`
+	LastModified      time.Time `json:"lastModified"`
+	ChecksumAlgorithm string    `json:"checksumAlgorithm,omitempty"`
+	Checksum          string    `json:"checksum,omitempty"`
+}
+
 // PartStorage stores multipart upload parts
 type PartStorage struct {
 	partStorageFolder string
+	tmpFolder         string
+	locks             *keyLocks // upload ids are held for reading while storing parts, for writing while completing or aborting
 }
 
 // NewPartStorage returns new PartStorage
 func NewPartStorage(s3DataFolder string) *PartStorage {
 	return &PartStorage{
 		partStorageFolder: filepath.Join(s3DataFolder, "parts"),
+		tmpFolder:         filepath.Join(s3DataFolder, "tmp"),
+		locks:             newKeyLocks(),
 	}
 }
 
-// StorePart stores a part to the storage
-func (ps *PartStorage) StorePart(uploadID string, partNumber int, source io.Reader) error {
-	uploadFolder := filepath.Join(ps.partStorageFolder, uploadID)
-	err := os.MkdirAll(uploadFolder, 0755)
+// CreateUpload records a new multipart upload to an object and returns it
+func (ps *PartStorage) CreateUpload(bucket, objectKey, initiator string, identity *Identity, metadata *ObjectMetadata) (*UploadInfo, error) {
+	err := ValidateObjectKey(objectKey)
 	if err != nil {
-		return stacktrace.Propagate(err, "Cannot create upload folder %q", uploadFolder)
+		return nil, err
+	}
+	uploadInfo := &UploadInfo{
+		UploadID:           uuid.NewV4().String(),
+		Bucket:             bucket,
+		Key:                objectKey,
+		Initiated:          time.Now().UTC(),
+		Initiator:          initiator,
+		Metadata:           metadata,
+		InitiatorPrincipal: identity.Initiator(),
+		Owner:              identity.Owner(),
+	}
+	uploadFolder := filepath.Join(ps.partStorageFolder, uploadInfo.UploadID)
+	err = os.MkdirAll(uploadFolder, 0755)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot create upload folder %q", uploadFolder)
+	}
+	content, err := json.Marshal(uploadInfo)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot marshal upload info for %q", uploadInfo.UploadID)
+	}
+	uploadInfoTmpPath, err := writeTmpFile(ps.tmpFolder, "upload-info-", content)
+	if err == nil {
+		err = commitFile(uploadInfoTmpPath, filepath.Join(uploadFolder, uploadInfoFile))
 	}
-	partFile := filepath.Join(uploadFolder, fmt.Sprintf("part-%d", partNumber))
-	w, err := os.Create(partFile)
 	if err != nil {
-		return stacktrace.Propagate(err, "Cannot create part file %q", partFile)
+		os.RemoveAll(uploadFolder)
+		return nil, err
 	}
-	defer w.Close()
-	_, err = io.Copy(w, source)
-	return stacktrace.Propagate(err, "Cannot write to part file %q", partFile)
+	return uploadInfo, nil
 }
 
-// MergeParts merges all parts of an upload and write to a sink
-func (ps *PartStorage) MergeParts(uploadID string, sink io.Writer) error {
+// GetUpload returns a multipart upload in progress. The upload must have been initiated for the same bucket and key
+func (ps *PartStorage) GetUpload(bucket, objectKey, uploadID string) (*UploadInfo, error) {
+	// Upload ids are generated uuids, anything else cannot be an upload and must not be joined to a path
+	parsedID, err := uuid.FromString(uploadID)
+	if err != nil || parsedID.String() != uploadID {
+		return nil, stacktrace.NewErrorWithCode(ErrCodeNoSuchUpload, "Invalid upload id %q", uploadID)
+	}
+	uploadInfo, err := ps.readUploadInfo(uploadID)
+	if os.IsNotExist(stacktrace.RootCause(err)) {
+		return nil, stacktrace.PropagateWithCode(err, ErrCodeNoSuchUpload, "Upload %q does not exist", uploadID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if uploadInfo.Bucket != bucket || uploadInfo.Key != objectKey {
+		return nil, stacktrace.NewErrorWithCode(ErrCodeNoSuchUpload, "Upload %q was initiated for object %q in bucket %q", uploadID, uploadInfo.Key, uploadInfo.Bucket)
+	}
+	return uploadInfo, nil
+}
+
+func (ps *PartStorage) readUploadInfo(uploadID string) (*UploadInfo, error) {
+	uploadInfoFile := filepath.Join(ps.partStorageFolder, uploadID, uploadInfoFile)
+	content, err := ioutil.ReadFile(uploadInfoFile)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot read upload info file %q", uploadInfoFile)
+	}
+	uploadInfo := &UploadInfo{}
+	err = json.Unmarshal(content, uploadInfo)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Invalid upload info file %q", uploadInfoFile)
+	}
+	if uploadInfo.Metadata == nil {
+		uploadInfo.Metadata = &ObjectMetadata{}
+	}
+	return uploadInfo, nil
+}
+
+// AbortUpload aborts a multipart upload in progress and deletes its parts
+func (ps *PartStorage) AbortUpload(bucket, objectKey, uploadID string) error {
+	unlock := ps.locks.lock(uploadID)
+	defer unlock()
+	_, err := ps.GetUpload(bucket, objectKey, uploadID)
+	if err != nil {
+		return err
+	}
 	uploadFolder := filepath.Join(ps.partStorageFolder, uploadID)
-	parts, err := ioutil.ReadDir(uploadFolder)
+	err = os.RemoveAll(uploadFolder)
+	return stacktrace.Propagate(err, "Cannot delete upload folder %q", uploadFolder)
+}
+
+// ListUploads returns all multipart uploads in progress in a bucket, sorted by key then initiation time
+func (ps *PartStorage) ListUploads(bucket string) ([]*UploadInfo, error) {
+	entries, err := ioutil.ReadDir(ps.partStorageFolder)
+	if os.IsNotExist(err) {
+		return []*UploadInfo{}, nil
+	}
 	if err != nil {
-		return stacktrace.Propagate(err, "Cannot read upload folder %q", uploadFolder)
+		return nil, stacktrace.Propagate(err, "Cannot read part storage folder %q", ps.partStorageFolder)
 	}
-	partNums := []int{}
-	for _, part := range parts {
-		partNum, err := strconv.ParseInt(strings.TrimPrefix(part.Name(), "part-"), 10, 64)
+	uploads := []*UploadInfo{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		uploadInfo, err := ps.readUploadInfo(entry.Name())
+		if os.IsNotExist(stacktrace.RootCause(err)) {
+			// Upload folders created by older versions have no upload info
+			continue
+		}
 		if err != nil {
-			return stacktrace.Propagate(err, "Invalid part name: %q", part.Name())
+			return nil, err
+		}
+		if uploadInfo.Bucket == bucket {
+			uploads = append(uploads, uploadInfo)
 		}
-		partNums = append(partNums, int(partNum))
 	}
-	sort.Ints(partNums)
+	sort.Slice(uploads, func(i, j int) bool {
+		if uploads[i].Key != uploads[j].Key {
+			return uploads[i].Key < uploads[j].Key
+		}
+		if !uploads[i].Initiated.Equal(uploads[j].Initiated) {
+			return uploads[i].Initiated.Before(uploads[j].Initiated)
+		}
+		return uploads[i].UploadID < uploads[j].UploadID
+	})
+	return uploads, nil
+}
+
+// ListParts returns all stored parts of a multipart upload in progress, sorted by part number
+func (ps *PartStorage) ListParts(bucket, objectKey, uploadID string) ([]*PartInfo, error) {
+	_, err := ps.GetUpload(bucket, objectKey, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	partNums, err := ps.partNumbers(uploadID)
+	if err != nil {
+		return nil, err
+	}
+	parts := make([]*PartInfo, 0, len(partNums))
 	for _, partNum := range partNums {
-		partFile := filepath.Join(uploadFolder, fmt.Sprintf("part-%d", partNum))
-		r, err := os.Open(partFile)
+		partInfo, err := ps.readPartInfo(uploadID, partNum)
 		if err != nil {
-			return stacktrace.Propagate(err, "Cannot open part file %q", partFile)
+			return nil, err
 		}
-		_, err = io.Copy(sink, r)
+		parts = append(parts, partInfo)
+	}
+	return parts, nil
+}
+
+// CompletedPart is a part listed by the client when completing an upload
+type CompletedPart struct {
+	PartNumber int
+	ETag       string // unquoted
+	Checksum   string // base64, empty if the client did not list it
+}
+
+// StorePart stores a part of an upload in progress to the storage
+func (ps *PartStorage) StorePart(bucket, objectKey, uploadID string, partNumber int, payload *Payload) (*PartInfo, error) {
+	uploadInfo, err := ps.GetUpload(bucket, objectKey, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	// Parts are checksummed with the algorithm of their upload, so a composite checksum can be computed from them
+	partPayload := *payload
+	uploadChecksumAlgorithm := uploadInfo.Metadata.ChecksumAlgorithm
+	if uploadChecksumAlgorithm != "" {
+		if payload.ChecksumAlgorithm != "" && payload.ChecksumAlgorithm != uploadChecksumAlgorithm {
+			return nil, stacktrace.NewErrorWithCode(ErrCodeChecksumAlgorithmMismatch, "Upload %q expects %s checksums, got %s", uploadID, uploadChecksumAlgorithm, payload.ChecksumAlgorithm)
+		}
+		partPayload.ChecksumAlgorithm = uploadChecksumAlgorithm
+	}
+	partFile := ps.partFile(uploadID, partNumber)
+	stored, err := writeTmpPayload(ps.tmpFolder, "part-", &partPayload)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot write part file %q", partFile)
+	}
+	partTmpPath := stored.tmpPath
+	stat, err := os.Stat(partTmpPath)
+	if err != nil {
+		os.Remove(partTmpPath)
+		return nil, stacktrace.Propagate(err, "Cannot stat part tmp file %q", partTmpPath)
+	}
+	partInfo := &PartInfo{
+		PartNumber:        partNumber,
+		ETag:              hex.EncodeToString(stored.md5),
+		Size:              stat.Size(),
+		LastModified:      time.Now().UTC(),
+		ChecksumAlgorithm: stored.checksumAlgorithm,
+		Checksum:          stored.checksum,
+	}
+	content, err := json.Marshal(partInfo)
+	if err != nil {
+		os.Remove(partTmpPath)
+		return nil, stacktrace.Propagate(err, "Cannot marshal part info for %q", partFile)
+	}
+	partInfoTmpPath, err := writeTmpFile(ps.tmpFolder, "part-info-", content)
+	if err != nil {
+		os.Remove(partTmpPath)
+		return nil, err
+	}
+	unlock := ps.lockPart(uploadID, partNumber)
+	defer unlock()
+	// The upload may have been completed or aborted while the part was received
+	_, err = ps.GetUpload(bucket, objectKey, uploadID)
+	if err != nil {
+		os.Remove(partTmpPath)
+		os.Remove(partInfoTmpPath)
+		return nil, err
+	}
+	err = commitFile(partTmpPath, partFile)
+	if err != nil {
+		os.Remove(partInfoTmpPath)
+		return nil, err
+	}
+	err = commitFile(partInfoTmpPath, partFile+partInfoSuffix)
+	if err != nil {
+		return nil, err
+	}
+	return partInfo, nil
+}
+
+// MergeParts validates the parts listed by the client, merges them in order to a sink, then calls commit with the
+// ETag of the merged object along with the info of each part. The upload stays locked until commit returns and is
+// only removed if commit succeeds, so only one of concurrent completions of an upload succeeds and a failed one can be retried
+func (ps *PartStorage) MergeParts(bucket, objectKey, uploadID string, parts []*CompletedPart, sink io.Writer, commit func(string, []*PartInfo) error) error {
+	unlock := ps.locks.lock(uploadID)
+	defer unlock()
+	_, err := ps.GetUpload(bucket, objectKey, uploadID)
+	if err != nil {
+		return err
+	}
+	partInfos, err := ps.validateParts(uploadID, parts)
+	if err != nil {
+		return err
+	}
+	// The ETag of a multipart object is the md5 of the concatenated binary md5 of its parts, followed by the number of parts
+	etagHasher := md5.New()
+	for i, part := range parts {
+		partMD5, partSize, err := ps.copyPart(uploadID, part.PartNumber, sink)
 		if err != nil {
-			return stacktrace.Propagate(err, "Cannot write to destination for part file %q", partFile)
+			return err
 		}
+		etagHasher.Write(partMD5)
+		partInfos[i].Size = partSize
 	}
-	os.RemoveAll(uploadFolder)
+	err = commit(fmt.Sprintf("%s-%d", hex.EncodeToString(etagHasher.Sum(nil)), len(parts)), partInfos)
+	if err != nil {
+		return err
+	}
+	os.RemoveAll(filepath.Join(ps.partStorageFolder, uploadID))
 	return nil
 }
+
+// validateParts checks that the listed parts are in ascending order, were uploaded with the given ETags and checksums
+// and that all parts but the last one are at least MinPartSize bytes. Returns the info of the listed parts
+func (ps *PartStorage) validateParts(uploadID string, parts []*CompletedPart) ([]*PartInfo, error) {
+	for i := 1; i < len(parts); i++ {
+		if parts[i].PartNumber <= parts[i-1].PartNumber {
+			return nil, stacktrace.NewErrorWithCode(ErrCodeInvalidPartOrder, "Part %d is listed after part %d", parts[i].PartNumber, parts[i-1].PartNumber)
+		}
+	}
+	partInfos := make([]*PartInfo, 0, len(parts))
+	for i, part := range parts {
+		partInfo, err := ps.readPartInfo(uploadID, part.PartNumber)
+		if err != nil {
+			return nil, err
+		}
+		if partInfo.ETag != part.ETag {
+			return nil, stacktrace.NewErrorWithCode(ErrCodeInvalidPart, "ETag %q does not match part %d of upload %q", part.ETag, part.PartNumber, uploadID)
+		}
+		if part.Checksum != "" && partInfo.Checksum != part.Checksum {
+			return nil, stacktrace.NewErrorWithCode(ErrCodeInvalidPart, "Checksum %q does not match part %d of upload %q", part.Checksum, part.PartNumber, uploadID)
+		}
+		if i < len(parts)-1 && partInfo.Size < MinPartSize {
+			return nil, stacktrace.NewErrorWithCode(ErrCodeEntityTooSmall, "Part %d of upload %q is only %d bytes", part.PartNumber, uploadID, partInfo.Size)
+		}
+		partInfos = append(partInfos, partInfo)
+	}
+	return partInfos, nil
+}
+
+// readPartInfo reads the info of a stored part. Parts stored by older versions have no info file, it is computed from the part file for them
+func (ps *PartStorage) readPartInfo(uploadID string, partNumber int) (*PartInfo, error) {
+	partFile := ps.partFile(uploadID, partNumber)
+	stat, err := os.Stat(partFile)
+	if err != nil {
+		return nil, stacktrace.PropagateWithCode(err, ErrCodeInvalidPart, "Part %d of upload %q not found", partNumber, uploadID)
+	}
+	content, err := ioutil.ReadFile(partFile + partInfoSuffix)
+	if os.IsNotExist(err) {
+		etag, err := fileMD5(partFile)
+		if err != nil {
+			return nil, err
+		}
+		return &PartInfo{
+			PartNumber:   partNumber,
+			ETag:         etag,
+			Size:         stat.Size(),
+			LastModified: stat.ModTime().UTC(),
+		}, nil
+	}
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot read part info for %q", partFile)
+	}
+	partInfo := &PartInfo{}
+	err = json.Unmarshal(content, partInfo)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Invalid part info for %q", partFile)
+	}
+	return partInfo, nil
+}
+
+// copyPart copies a part to sink and returns its binary md5 and size
+func (ps *PartStorage) copyPart(uploadID string, partNumber int, sink io.Writer) ([]byte, int64, error) {
+	partFile := ps.partFile(uploadID, partNumber)
+	r, err := os.Open(partFile)
+	if err != nil {
+		return nil, 0, stacktrace.Propagate(err, "Cannot open part file %q", partFile)
+	}
+	defer r.Close()
+	hasher := md5.New()
+	size, err := io.Copy(io.MultiWriter(sink, hasher), r)
+	if err != nil {
+		return nil, 0, stacktrace.Propagate(err, "Cannot write to destination for part file %q", partFile)
+	}
+	return hasher.Sum(nil), size, nil
+}
+
+// partNumbers returns the sorted numbers of all stored parts of an upload
+func (ps *PartStorage) partNumbers(uploadID string) ([]int, error) {
+	uploadFolder := filepath.Join(ps.partStorageFolder, uploadID)
+	entries, err := ioutil.ReadDir(uploadFolder)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot read upload folder %q", uploadFolder)
+	}
+	partNums := []int{}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "part-") || strings.HasSuffix(entry.Name(), partInfoSuffix) {
+			continue
+		}
+		partNum, err := strconv.Atoi(strings.TrimPrefix(entry.Name(), "part-"))
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "Invalid part name: %q", entry.Name())
+		}
+		partNums = append(partNums, partNum)
+	}
+	sort.Ints(partNums)
+	return partNums, nil
+}
+
+// lockPart locks a part for writing, and its upload against completion and abortion
+func (ps *PartStorage) lockPart(uploadID string, partNumber int) func() {
+	unlockUpload := ps.locks.rlock(uploadID)
+	unlockPart := ps.locks.lock(fmt.Sprintf("%s/%d", uploadID, partNumber))
+	return func() {
+		unlockPart()
+		unlockUpload()
+	}
+}
+
+func (ps *PartStorage) partFile(uploadID string, partNumber int) string {
+	return filepath.Join(ps.partStorageFolder, uploadID, fmt.Sprintf("part-%d", partNumber))
+}
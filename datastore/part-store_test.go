@@ -0,0 +1,65 @@
+package datastore
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// createTestUpload initiates an upload of objectKey with a single part and returns its id and the part to complete it with
+func createTestUpload(t *testing.T, storages *testStorages, objectKey, content string) (string, *CompletedPart) {
+	uploadInfo, err := storages.partStorage.CreateUpload(testBucket, objectKey, "", DefaultIdentity(), &ObjectMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	partInfo, err := storages.partStorage.StorePart(testBucket, objectKey, uploadInfo.UploadID, 1, newTestPayload(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uploadInfo.UploadID, &CompletedPart{PartNumber: 1, ETag: partInfo.ETag}
+}
+
+func TestMergePartsKeepsUploadWhenCommitFails(t *testing.T) {
+	storages, cleanup := newTestStorages(t)
+	defer cleanup()
+	uploadID, part := createTestUpload(t, storages, "key", "content")
+	commitErr := errors.New("commit failed")
+	err := storages.partStorage.MergeParts(testBucket, "key", uploadID, []*CompletedPart{part}, ioutil.Discard, func(string, []*PartInfo) error {
+		return commitErr
+	})
+	if err != commitErr {
+		t.Fatalf("MergeParts returned %v, expecting the commit error", err)
+	}
+	if _, err := storages.partStorage.GetUpload(testBucket, "key", uploadID); err != nil {
+		t.Fatalf("Upload was removed by a failed completion: %s", err)
+	}
+	metadata, err := storages.objectStorage.MergeParts(testBucket, "key", uploadID, []*CompletedPart{part}, storages.partStorage)
+	if err != nil {
+		t.Fatalf("Completion cannot be retried: %s", err)
+	}
+	if metadata.ETag == "" || len(metadata.PartSizes) != 1 || metadata.PartSizes[0] != int64(len("content")) {
+		t.Errorf("Unexpected merged metadata %+v", metadata)
+	}
+	if _, err := storages.partStorage.GetUpload(testBucket, "key", uploadID); err == nil {
+		t.Error("Upload was kept after a successful completion")
+	}
+}
+
+func TestMergePartsRemovesTmpFileOnError(t *testing.T) {
+	storages, cleanup := newTestStorages(t)
+	defer cleanup()
+	uploadID, part := createTestUpload(t, storages, "key", "content")
+	part.ETag = "0123456789abcdef0123456789abcdef"
+	_, err := storages.objectStorage.MergeParts(testBucket, "key", uploadID, []*CompletedPart{part}, storages.partStorage)
+	if err == nil {
+		t.Fatal("MergeParts accepted a part with a wrong ETag")
+	}
+	tmpFiles, err := ioutil.ReadDir(filepath.Join(storages.dataFolder, "tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tmpFiles) != 0 {
+		t.Errorf("%d tmp files left after a failed completion", len(tmpFiles))
+	}
+}
@@ -0,0 +1,87 @@
+package datastore
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Payload is the content of an object or part being stored, along with the digests announced by the client
+type Payload struct {
+	Reader            io.Reader
+	Size              int64  // number of bytes Reader must provide, negative if unknown
+	ContentMD5        []byte // binary md5 from the Content-MD5 header, nil if not announced
+	ContentSHA256     []byte // binary sha256 from the x-amz-content-sha256 header, nil if not announced
+	ChecksumAlgorithm string // algorithm of the checksum to compute, empty for the default one
+	Checksum          string // base64 checksum from the x-amz-checksum-* header, empty if not announced
+	// TrailingChecksum returns the base64 checksum sent after the content, once Reader is consumed. nil if the checksum is not trailing
+	TrailingChecksum func() string
+}
+
+// NewPayload returns a payload without announced digests
+func NewPayload(reader io.Reader, size int64) *Payload {
+	return &Payload{
+		Reader: reader,
+		Size:   size,
+	}
+}
+
+// storedPayload describes a payload written to the tmp folder
+type storedPayload struct {
+	tmpPath           string
+	md5               []byte
+	checksumAlgorithm string
+	checksum          string // base64
+}
+
+// writeTmpPayload copies a payload to a new file in tmpFolder and returns where it was stored along with its digests.
+// The file is discarded if the payload does not have the announced size or digests
+func writeTmpPayload(tmpFolder, prefix string, payload *Payload) (*storedPayload, error) {
+	checksumAlgorithm := payload.ChecksumAlgorithm
+	if checksumAlgorithm == "" {
+		checksumAlgorithm = DefaultChecksumAlgorithm
+	}
+	checksumHasher, ok := NewChecksumHash(checksumAlgorithm)
+	if !ok {
+		return nil, stacktrace.NewError("Unsupported checksum algorithm %q", checksumAlgorithm)
+	}
+	md5Hasher := md5.New()
+	hashers := []io.Writer{md5Hasher, checksumHasher}
+	var sha256Hasher hash.Hash
+	if payload.ContentSHA256 != nil {
+		sha256Hasher = sha256.New()
+		hashers = append(hashers, sha256Hasher)
+	}
+	tmpPath, err := writeTmpStream(tmpFolder, prefix, io.TeeReader(payload.Reader, io.MultiWriter(hashers...)), payload.Size)
+	if err != nil {
+		return nil, err
+	}
+	stored := &storedPayload{
+		tmpPath:           tmpPath,
+		md5:               md5Hasher.Sum(nil),
+		checksumAlgorithm: checksumAlgorithm,
+		checksum:          encodeChecksum(checksumHasher.Sum(nil)),
+	}
+	if payload.ContentMD5 != nil && !bytes.Equal(payload.ContentMD5, stored.md5) {
+		os.Remove(tmpPath)
+		return nil, stacktrace.NewErrorWithCode(ErrCodeBadDigest, "Content-MD5 does not match the received payload")
+	}
+	if sha256Hasher != nil && !bytes.Equal(payload.ContentSHA256, sha256Hasher.Sum(nil)) {
+		os.Remove(tmpPath)
+		return nil, stacktrace.NewErrorWithCode(ErrCodeSHA256Mismatch, "x-amz-content-sha256 does not match the received payload")
+	}
+	expectedChecksum := payload.Checksum
+	if payload.TrailingChecksum != nil {
+		expectedChecksum = payload.TrailingChecksum()
+	}
+	if expectedChecksum != "" && expectedChecksum != stored.checksum {
+		os.Remove(tmpPath)
+		return nil, stacktrace.NewErrorWithCode(ErrCodeChecksumMismatch, "x-amz-checksum-%s %q does not match the received payload", checksumAlgorithm, expectedChecksum)
+	}
+	return stored, nil
+}
@@ -0,0 +1,42 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testBucket = "test-bucket"
+
+// testStorages holds storages sharing a data folder in the tmp folder, with testBucket created
+type testStorages struct {
+	dataFolder    string
+	bucketStorage *BucketStorage
+	partStorage   *PartStorage
+	objectStorage *ObjectStorage
+}
+
+func newTestStorages(t *testing.T) (*testStorages, func()) {
+	dataFolder, err := ioutil.TempDir("", "fakes3-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucketStorage := NewBucketStorage(dataFolder, false)
+	storages := &testStorages{
+		dataFolder:    dataFolder,
+		bucketStorage: bucketStorage,
+		partStorage:   NewPartStorage(dataFolder),
+		objectStorage: NewObjectStorage(dataFolder, bucketStorage),
+	}
+	err = bucketStorage.CreateBucket(testBucket, "")
+	if err != nil {
+		os.RemoveAll(dataFolder)
+		t.Fatal(err)
+	}
+	return storages, func() { os.RemoveAll(dataFolder) }
+}
+
+func newTestPayload(content string) *Payload {
+	return NewPayload(strings.NewReader(content), int64(len(content)))
+}
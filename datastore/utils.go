@@ -1,8 +1,13 @@
 package datastore
 
 import (
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/palantir/stacktrace"
 )
@@ -12,3 +17,109 @@ func createParentDirForFile(file string) error {
 	err := os.MkdirAll(parentDir, 0755)
 	return stacktrace.Propagate(err, "Cannot create parent dir for %q", file)
 }
+
+// removeEmptyParents removes the folders containing a deleted file as long as they are empty, up to stopFolder excluded
+func removeEmptyParents(file, stopFolder string) {
+	for dir := filepath.Dir(file); dir != stopFolder && strings.HasPrefix(dir, stopFolder); dir = filepath.Dir(dir) {
+		// Remove fails on folders that are not empty
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+// createTmpFile creates a new file with a unique name in tmpFolder
+func createTmpFile(tmpFolder, prefix string) (*os.File, error) {
+	err := os.MkdirAll(tmpFolder, 0755)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot create tmp folder %q", tmpFolder)
+	}
+	f, err := ioutil.TempFile(tmpFolder, prefix)
+	return f, stacktrace.Propagate(err, "Cannot create tmp file in %q", tmpFolder)
+}
+
+// syncAndClose flushes a tmp file to disk and closes it. The file is removed if it cannot be flushed
+func syncAndClose(f *os.File) error {
+	err := f.Sync()
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return stacktrace.Propagate(err, "Cannot write tmp file %q", f.Name())
+	}
+	return nil
+}
+
+// writeTmpFile writes content to a new file in tmpFolder and returns its path
+func writeTmpFile(tmpFolder, prefix string, content []byte) (string, error) {
+	f, err := createTmpFile(tmpFolder, prefix)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(content)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", stacktrace.Propagate(err, "Cannot write tmp file %q", f.Name())
+	}
+	return f.Name(), syncAndClose(f)
+}
+
+// writeTmpStream copies source to a new file in tmpFolder and returns its path.
+// Unless size is negative, source must provide exactly size bytes
+func writeTmpStream(tmpFolder, prefix string, source io.Reader, size int64) (string, error) {
+	f, err := createTmpFile(tmpFolder, prefix)
+	if err != nil {
+		return "", err
+	}
+	written, err := io.Copy(f, source)
+	if err == nil && size >= 0 && written != size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		if err == io.ErrUnexpectedEOF {
+			return "", stacktrace.NewErrorWithCode(ErrCodeIncompleteBody, "Received %d bytes out of %d", written, size)
+		}
+		return "", stacktrace.Propagate(err, "Cannot write tmp file %q", f.Name())
+	}
+	return f.Name(), syncAndClose(f)
+}
+
+// commitFile atomically moves a tmp file to its final path, so readers only ever see complete files.
+// The tmp file is removed if it cannot be moved
+func commitFile(tmpPath, path string) error {
+	err := createParentDirForFile(path)
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return stacktrace.Propagate(err, "Cannot move tmp file %q to %q", tmpPath, path)
+	}
+	// Flush the folder entry too, so the rename survives a crash
+	dir, err := os.Open(filepath.Dir(path))
+	if err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// fileMD5 returns the hex md5 of a file content
+func fileMD5(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", stacktrace.Propagate(err, "Cannot open %q", file)
+	}
+	defer f.Close()
+	hasher := md5.New()
+	_, err = io.Copy(hasher, f)
+	if err != nil {
+		return "", stacktrace.Propagate(err, "Cannot read %q", file)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}